@@ -0,0 +1,44 @@
+package socks5
+
+import (
+	"net"
+	"time"
+)
+
+// AccessLogEntry describes a served request for access logs
+type AccessLogEntry struct {
+	// Time is when the request was received
+	Time time.Time
+	// Duration is how long the request was served for
+	Duration time.Duration
+	// RemoteAddr is the client's address
+	RemoteAddr net.Addr
+	// Username is the authenticated username, if any
+	Username string
+	// Command is the requested command
+	Command Command
+	// Destination is the requested destination, as rewritten if it was
+	Destination *Address
+	// BytesSent is the number of bytes sent from the client
+	BytesSent int64
+	// BytesReceived is the number of bytes received by the client
+	BytesReceived int64
+	// Err is the error the request failed with, if any
+	Err error
+}
+
+// logAccess calls AccessLog with the entry of req, received at start,
+// once it is done with *err.
+func (s *Server) logAccess(req *Request, start time.Time, err *error) {
+	s.AccessLog(AccessLogEntry{
+		Time:          start,
+		Duration:      time.Since(start),
+		RemoteAddr:    req.RemoteAddr,
+		Username:      req.Username,
+		Command:       req.Command,
+		Destination:   req.DestinationAddr,
+		BytesSent:     req.sent,
+		BytesReceived: req.received,
+		Err:           *err,
+	})
+}
@@ -1,14 +1,26 @@
 package socks5
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -274,3 +286,4857 @@ func TestSimpleServer(t *testing.T) {
 	}
 	resp.Body.Close()
 }
+
+func TestServerShutdown(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewServer()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- proxy.Serve(listen)
+	}()
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: dial.DialContext,
+	}
+	resp, err := cli.Get(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cli.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = proxy.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Fatalf("want %v, got %v", ErrServerClosed, err)
+	}
+	if err := proxy.Serve(listen); err != ErrServerClosed {
+		t.Fatalf("want %v, got %v", ErrServerClosed, err)
+	}
+}
+
+func TestClientReplyError(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("want *ReplyError, got %v", err)
+	}
+	if replyErr.Code() != ConnectionRefusedReply {
+		t.Fatalf("want code %d, got %d", ConnectionRefusedReply, replyErr.Code())
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.IdleTimeout = time.Second / 10
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1]byte
+	_, err = conn.Read(buf[:])
+	if err != io.EOF {
+		t.Fatalf("want %v, got %v", io.EOF, err)
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	proxy.HandshakeTimeout = time.Second / 10
+	go proxy.Serve(listen)
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{socks5Version, 1, byte(userAuth)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{socks5Version, byte(userAuth), userAuthVersion, authFailure}
+	if !bytes.Equal(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func TestServerHandshakeTimeoutProxyProtocol(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.ProxyProtocol = true
+	proxy.HandshakeTimeout = time.Second / 10
+	go proxy.Serve(listen)
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Send no PROXY protocol header at all.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1]byte
+	_, err = conn.Read(buf[:])
+	if err != io.EOF {
+		t.Fatalf("want %v, got %v", io.EOF, err)
+	}
+}
+
+func BenchmarkUDPAddrEqual(b *testing.B) {
+	a1 := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1080}
+	a2 := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1080}
+	b.Run("String", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if a1.String() != a2.String() {
+				b.Fatal("not equal")
+			}
+		}
+	})
+	b.Run("Fields", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if !udpAddrEqual(a1, a2) {
+				b.Fatal("not equal")
+			}
+		}
+	})
+}
+
+func TestUDPFragment(t *testing.T) {
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packet.Close()
+	go func() {
+		var buf [maxUdpPacket]byte
+		for {
+			n, addr, err := packet.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			_, err = packet.WriteTo(buf[:n], addr)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.MaxUDPFragmentAge = 5 * time.Second
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dial.Dial("udp", packet.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	udpConn := conn.(*UDPConn)
+	udpConn.prefix = []byte{0, 0, 1}
+	_, err = udpConn.Write([]byte("hel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn.prefix = []byte{0, 0, 0x82}
+	_, err = udpConn.Write([]byte("lo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 16)
+	n, err := conn.Read(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got[:n]) != "hello" {
+		t.Fatalf("want %q, got %q", "hello", got[:n])
+	}
+}
+
+func TestUDPReassemblerLostFragment(t *testing.T) {
+	r := &udpReassembler{maxAge: time.Minute}
+	if got := r.add(1, []byte("a")); got != nil {
+		t.Fatalf("want no datagram, got %q", got)
+	}
+	// Fragment 2 is lost.
+	if got := r.add(3|0x80, []byte("c")); got != nil {
+		t.Fatalf("want the queue discarded, got %q", got)
+	}
+	if got := r.add(2|0x80, []byte("b")); got != nil {
+		t.Fatalf("want a queue starting at 1, got %q", got)
+	}
+
+	if got := r.add(1, []byte("a")); got != nil {
+		t.Fatalf("want no datagram, got %q", got)
+	}
+	if got := r.add(2|0x80, []byte("b")); string(got) != "ab" {
+		t.Fatalf("want %q, got %q", "ab", got)
+	}
+}
+
+func TestUDPTargetsBounded(t *testing.T) {
+	targets := newUDPTargets(2)
+	now := time.Now()
+	keys := make([]udpAddrKey, 3)
+	for i := range keys {
+		keys[i] = newUDPAddrKey(net.IPv4(192, 0, 2, byte(i)), 53, "")
+	}
+	targets.add(keys[0], &udpTarget{}, now)
+	targets.add(keys[1], &udpTarget{}, now.Add(time.Second))
+	// Using the first destination makes the second the least recent.
+	targets.get(keys[0], now.Add(2*time.Second))
+	targets.add(keys[2], &udpTarget{}, now.Add(3*time.Second))
+
+	if len(targets.targets) != 2 {
+		t.Fatalf("want 2 destinations, got %d", len(targets.targets))
+	}
+	if _, ok := targets.get(keys[1], now); ok {
+		t.Fatal("want the least recently used destination forgotten")
+	}
+	if _, ok := targets.get(keys[0], now); !ok {
+		t.Fatal("want the recently used destination kept")
+	}
+}
+
+func TestUDPNamesBounded(t *testing.T) {
+	names := newUDPNames(2, time.Minute)
+	now := time.Now()
+	ip := net.IPv4(192, 0, 2, 1)
+	names.add("a.test", ip, now)
+	if got := names.get("a.test", now.Add(time.Second)); !got.Equal(ip) {
+		t.Fatalf("want %v, got %v", ip, got)
+	}
+	if got := names.get("a.test", now.Add(2*time.Minute)); got != nil {
+		t.Fatalf("want the name expired, got %v", got)
+	}
+
+	for i := 0; i < 10; i++ {
+		names.add(strconv.Itoa(i)+".test", ip, now)
+	}
+	if len(names.names) > 2 {
+		t.Fatalf("want at most 2 names, got %d", len(names.names))
+	}
+}
+
+type testGSSAPI struct{}
+
+func (testGSSAPI) NewSecContext() GSSAPISecContext {
+	return testGSSAPISecContext{}
+}
+
+type testGSSAPISecContext struct{}
+
+func (testGSSAPISecContext) AcceptSecContext(token []byte) ([]byte, bool, error) {
+	if string(token) != "token" {
+		return nil, false, errors.New("bad token")
+	}
+	return []byte("ok"), true, nil
+}
+
+func (testGSSAPISecContext) Protection(requested byte) byte {
+	return GSSAPIIntegrity
+}
+
+func (testGSSAPISecContext) Wrap(msg []byte) ([]byte, error) {
+	return append([]byte("wrap:"), msg...), nil
+}
+
+func (testGSSAPISecContext) Unwrap(token []byte) ([]byte, error) {
+	if !bytes.HasPrefix(token, []byte("wrap:")) {
+		return nil, errors.New("bad wrap")
+	}
+	return token[len("wrap:"):], nil
+}
+
+func TestServerGSSAPI(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	proxy.GSSAPIAuthenticator = testGSSAPI{}
+	go proxy.Serve(listen)
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	_, err = conn.Write([]byte{socks5Version, 2, byte(userAuth), byte(gssapiAuth)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var method [2]byte
+	_, err = io.ReadFull(conn, method[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authMethod(method[1]) != gssapiAuth {
+		t.Fatalf("want method %d, got %d", gssapiAuth, method[1])
+	}
+
+	err = writeGSSAPIMessage(conn, gssapiAuthMessage, []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtyp, token, err := readGSSAPIMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtyp != gssapiAuthMessage || string(token) != "ok" {
+		t.Fatalf("unexpected auth message %d %q", mtyp, token)
+	}
+
+	secCtx := testGSSAPISecContext{}
+	level, _ := secCtx.Wrap([]byte{GSSAPIConfidentiality})
+	err = writeGSSAPIMessage(conn, gssapiProtectionMessage, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtyp, token, err = readGSSAPIMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtyp != gssapiProtectionMessage || string(token) != "wrap:\x01" {
+		t.Fatalf("unexpected protection message %d %q", mtyp, token)
+	}
+
+	wrapped := &gssapiConn{Conn: conn, secCtx: secCtx}
+	dial := &Dialer{}
+	_, err = dial.connectCommand(wrapped, ConnectCommand, testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerAuthMethods(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.AuthMethods = []AuthMethod{
+		UserAuthMethod(UserAuth("u", "p")),
+		NoAuthMethod(),
+	}
+	go proxy.Serve(listen)
+
+	for _, u := range []string{"", "u:p@"} {
+		dial, err := NewDialer("socks5://" + u + listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	dial, err := NewDialer("socks5://u:x@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err == nil {
+		t.Fatal("want authentication error")
+	}
+}
+
+func TestServerRules(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	proxy.Rules = RuleSetFunc(func(ctx context.Context, req *Request) bool {
+		return req.RemoteAddr != nil && req.Username == "u" && req.DestinationAddr.Port != 25
+	})
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://u:p@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	_, err = dial.Dial("tcp", "127.0.0.1:25")
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code() != RuleFailureReply {
+		t.Fatalf("want %v, got %v", RuleFailureReply, err)
+	}
+}
+
+func TestServerMaxConnectionsReject(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.MaxConnections = 1
+	proxy.MaxConnectionsBehavior = MaxConnectionsReject
+	go proxy.Serve(listen)
+
+	conn1, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn1.Close()
+
+	conn2, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+
+	conn2.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1]byte
+	_, err = conn2.Read(buf[:])
+	if err != io.EOF {
+		t.Fatalf("want %v, got %v", io.EOF, err)
+	}
+}
+
+// closeDuringAuth opens a connection to addr offering username/password
+// authentication, and closes it once the method is selected.
+func closeDuringAuth(t *testing.T, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte{socks5Version, 1, byte(userAuth)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerClosedDuringAuth(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	served := make(chan error, 1)
+	go func() {
+		served <- proxy.Serve(listen)
+	}()
+
+	for i := 0; i < 2; i++ {
+		closeDuringAuth(t, listen.Addr().String())
+	}
+
+	dial, err := NewDialer("socks5://u:p@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("want %v, got %v", ErrServerClosed, err)
+	}
+}
+
+func TestServerMaxConnectionsBlockStop(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.MaxConnections = 1
+	proxy.Authentication = UserAuth("u", "p")
+	served := make(chan error, 1)
+	go func() {
+		served <- proxy.Serve(listen)
+	}()
+
+	// Clients closing during authentication free the only slot.
+	for i := 0; i < 2; i++ {
+		closeDuringAuth(t, listen.Addr().String())
+	}
+
+	dial, err := NewDialer("socks5://u:p@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial.Timeout = time.Second
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case err := <-served:
+		t.Fatalf("want Serve running, returned %v", err)
+	default:
+	}
+}
+
+func TestServerAcceptGate(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	var open int32
+	proxy := NewServer()
+	proxy.MaxConnections = 1
+	proxy.AcceptGate = func() bool {
+		return atomic.LoadInt32(&open) == 1
+	}
+	go proxy.Serve(listen)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var buf [1]byte
+		_, err = conn.Read(buf[:])
+		conn.Close()
+		if err != io.EOF {
+			t.Fatalf("want %v, got %v", io.EOF, err)
+		}
+	}
+
+	// Rejected connections must not hold MaxConnections slots.
+	atomic.StoreInt32(&open, 1)
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestTokenBucket(t *testing.T) {
+	limiter := NewTokenBucket(1000, 100)
+	ctx := context.Background()
+
+	start := time.Now()
+	err := limiter.WaitN(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = limiter.WaitN(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Fatalf("want to wait about 100ms, waited %v", d)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = limiter.WaitN(ctx, 100)
+	if err != context.Canceled {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+
+	err = limiter.WaitN(context.Background(), 101)
+	if err == nil {
+		t.Fatal("want burst error")
+	}
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	for _, burst := range []int{0, 100} {
+		limiter := NewTokenBucket(0, burst)
+		done := make(chan error, 1)
+		go func() {
+			done <- limiter.WaitN(context.Background(), 100)
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("burst %d: %v", burst, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("burst %d: want no wait", burst)
+		}
+	}
+}
+
+func TestServerRateLimitZero(t *testing.T) {
+	for _, limit := range []*RateLimit{{}, {Burst: 100}} {
+		client, server := net.Pipe()
+		c1, c2 := limit.wrap(context.Background(), client, server)
+		if c1 != client || c2 != server {
+			t.Fatalf("%+v: want connections unwrapped", *limit)
+		}
+
+		proxy := NewServer()
+		proxy.RateLimit = limit
+		dial := &Dialer{
+			ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return proxy.Pipe(), nil
+			},
+		}
+		conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("%+v: %v", *limit, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestServerOnConnClose(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	type counts struct {
+		sent, received int64
+	}
+	closed := make(chan counts, 1)
+	proxy := NewServer()
+	proxy.OnConnClose = func(req *Request, sent, received int64, err error) {
+		closed <- counts{sent, received}
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case got := <-closed:
+		if got.sent != 5 || got.received != 5 {
+			t.Fatalf("want 5/5 bytes, got %d/%d", got.sent, got.received)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnConnClose not called")
+	}
+}
+
+type testMetrics struct {
+	mu          sync.Mutex
+	connections int
+	bytes       int64
+	errors      []string
+}
+
+func (m *testMetrics) IncConnections(cmd Command) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections++
+}
+
+func (m *testMetrics) DecConnections(cmd Command) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections--
+}
+
+func (m *testMetrics) ObserveBytes(cmd Command, sent, recv int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes += sent + recv
+}
+
+func (m *testMetrics) IncErrors(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors = append(m.errors, reason)
+}
+
+func TestServerMetrics(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	metrics := &testMetrics{}
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	proxy.Metrics = metrics
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://u:x@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err == nil {
+		t.Fatal("want authentication error")
+	}
+
+	dial, err = NewDialer("socks5://u:p@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: dial.DialContext,
+	}
+	resp, err := cli.Get(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cli.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	proxy.Shutdown(ctx)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.connections != 0 {
+		t.Fatalf("want 0 connections, got %d", metrics.connections)
+	}
+	if metrics.bytes == 0 {
+		t.Fatal("want observed bytes")
+	}
+	if len(metrics.errors) != 1 || metrics.errors[0] != "auth_failed" {
+		t.Fatalf("want [auth_failed], got %v", metrics.errors)
+	}
+}
+
+func TestServerMetricsAssociate(t *testing.T) {
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packet.Close()
+	go func() {
+		var buf [maxUdpPacket]byte
+		n, addr, err := packet.ReadFrom(buf[:])
+		if err != nil {
+			return
+		}
+		packet.WriteTo(buf[:n], addr)
+	}()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	metrics := &testMetrics{}
+	proxy := NewServer()
+	proxy.Metrics = metrics
+	go proxy.Serve(listen)
+
+	// Closing the UDPConn leaves the control connection open.
+	var control net.Conn
+	dial := &Dialer{
+		ProxyNetwork: "tcp",
+		ProxyAddress: listen.Addr().String(),
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			c, err := net.Dial(network, address)
+			control = c
+			return c, err
+		},
+	}
+	conn, err := dial.Dial("udp", packet.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	control.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		metrics.mu.Lock()
+		n := metrics.bytes
+		metrics.mu.Unlock()
+		if n == 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want 10 observed bytes, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerChainDial(t *testing.T) {
+	upstreamListen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstreamListen.Close()
+
+	upstream := NewServer()
+	upstream.Authentication = UserAuth("u", "p")
+	upstream.Rules = RuleSetFunc(func(ctx context.Context, req *Request) bool {
+		return req.DestinationAddr.Port != 25
+	})
+	go upstream.Serve(upstreamListen)
+
+	upstreamDial, err := NewDialer("socks5://u:p@" + upstreamListen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.ProxyDial = ChainDial(upstreamDial)
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: dial.DialContext,
+	}
+	resp, err := cli.Get(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	_, err = dial.Dial("tcp", "127.0.0.1:25")
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code() != RuleFailureReply {
+		t.Fatalf("want %v, got %v", RuleFailureReply, err)
+	}
+}
+
+// closeNotifyConn is a net.Conn that closes the closed channel once closed.
+type closeNotifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestServerChainDialRejected(t *testing.T) {
+	upstream := NewServer()
+	upstream.Authentication = UserAuth("u", "p")
+	upstream.Rules = RuleSetFunc(func(ctx context.Context, req *Request) bool {
+		return req.DestinationAddr.Port != 25
+	})
+
+	for _, password := range []string{"p", "x"} {
+		conns := make(chan *closeNotifyConn, 1)
+		upstreamDial := &Dialer{
+			Username: "u",
+			Password: password,
+			ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				conn := &closeNotifyConn{Conn: upstream.Pipe(), closed: make(chan struct{})}
+				conns <- conn
+				return conn, nil
+			},
+		}
+		proxy := NewServer()
+		proxy.ProxyDial = ChainDial(upstreamDial)
+		dial := &Dialer{
+			ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return proxy.Pipe(), nil
+			},
+		}
+		_, err := dial.Dial("tcp", "127.0.0.1:25")
+		if err == nil {
+			t.Fatalf("password %q: want the upstream to reject the request", password)
+		}
+		select {
+		case <-(<-conns).closed:
+		case <-time.After(time.Second):
+			t.Fatalf("password %q: want the upstream connection closed", password)
+		}
+	}
+}
+
+func TestServerResolver(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.Resolver = NameResolverFunc(func(ctx context.Context, name string) (net.IP, error) {
+		if name != "proxy.test" {
+			return nil, errors.New("no such host")
+		}
+		return net.IPv4(127, 0, 0, 1), nil
+	})
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: dial.DialContext,
+	}
+	resp, err := cli.Get(strings.ReplaceAll(testServer.URL, "127.0.0.1", "proxy.test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestServerPassThroughNames(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.Resolver = NameResolverFunc(func(ctx context.Context, name string) (net.IP, error) {
+		return nil, errors.New("unexpected resolve")
+	})
+	proxy.PassThroughNames = true
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if !strings.HasPrefix(address, "localhost:") {
+			return nil, fmt.Errorf("unexpected address %s", address)
+		}
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, address)
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: dial.DialContext,
+	}
+	resp, err := cli.Get(strings.ReplaceAll(testServer.URL, "127.0.0.1", "localhost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestServerPassThroughNamesBlockPrivate(t *testing.T) {
+	proxy := NewServer()
+	proxy.PassThroughNames = true
+	proxy.BlockPrivateDestinations = true
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	_, port, _ := net.SplitHostPort(testServer.Listener.Addr().String())
+	_, err := dial.Dial("tcp", net.JoinHostPort("localhost", port))
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code() != RuleFailureReply {
+		t.Fatalf("want %v, got %v", RuleFailureReply, err)
+	}
+}
+
+func TestBindTimeout(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.BindTimeout = time.Second / 10
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := dial.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = listener.Accept()
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code() != TTLExpiredReply {
+		t.Fatalf("want %v, got %v", TTLExpiredReply, err)
+	}
+}
+
+func TestBindIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	ln.Close()
+
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.BindTimeout = time.Second
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.proxyDial(context.Background(), dial.ProxyNetwork, dial.ProxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = dial.connectAuth(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := dial.connectCommand(conn, BindCommand, "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := addr.(*Address)
+	if bind.IP.To4() != nil || !bind.IP.IsLoopback() {
+		t.Fatalf("want IPv6 loopback, got %v", bind)
+	}
+
+	inbound, err := net.Dial("tcp", bind.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inbound.Close()
+	_, err = dial.readReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPStrictSource(t *testing.T) {
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packet.Close()
+	go func() {
+		var buf [maxUdpPacket]byte
+		for {
+			n, addr, err := packet.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			_, err = packet.WriteTo(buf[:n], addr)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.StrictUDPSource = true
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dial.Dial("udp", packet.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]byte, 1024)
+	rand.Read(want)
+	_, err = conn.Write(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(want))
+	_, err = conn.Read(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fail()
+	}
+}
+
+func TestAllowedUDPSource(t *testing.T) {
+	req := &Request{
+		RemoteAddr:      &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234},
+		DestinationAddr: &Address{IP: net.IPv4zero, Port: 0},
+	}
+	if !allowedUDPSource(req, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5678}) {
+		t.Fatal("want allowed from the client IP")
+	}
+	if allowedUDPSource(req, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5678}) {
+		t.Fatal("want denied from another IP")
+	}
+	req.DestinationAddr.Port = 5678
+	if allowedUDPSource(req, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5679}) {
+		t.Fatal("want denied from another port")
+	}
+}
+
+func TestUDPMultipleDestinations(t *testing.T) {
+	var packets []net.PacketConn
+	for i := 0; i != 2; i++ {
+		packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer packet.Close()
+		go func() {
+			var buf [maxUdpPacket]byte
+			for {
+				n, addr, err := packet.ReadFrom(buf[:])
+				if err != nil {
+					return
+				}
+				_, err = packet.WriteTo(buf[:n], addr)
+				if err != nil {
+					return
+				}
+			}
+		}()
+		packets = append(packets, packet)
+	}
+
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dial.Dial("udp", packets[0].LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	udpConn := conn.(*UDPConn)
+
+	for _, packet := range packets {
+		want := []byte(packet.LocalAddr().String())
+		_, err = udpConn.WriteTo(want, packet.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 64)
+		n, addr, err := udpConn.ReadFrom(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, got[:n]) {
+			t.Fatalf("want %q, got %q", want, got[:n])
+		}
+		if addr.String() != packet.LocalAddr().String() {
+			t.Fatalf("want source %s, got %s", packet.LocalAddr(), addr)
+		}
+	}
+}
+
+func TestUDPTimeout(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.UDPTimeout = time.Second / 10
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.proxyDial(context.Background(), dial.ProxyNetwork, dial.ProxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = dial.connectAuth(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.connectCommand(conn, AssociateCommand, ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1]byte
+	_, err = conn.Read(buf[:])
+	if err != io.EOF {
+		t.Fatalf("want %v, got %v", io.EOF, err)
+	}
+}
+
+func TestServerUnsupportedVersion(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte{0x04})
+
+	proxy := NewServer()
+	_, err := proxy.handshake(context.Background(), server)
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("want %v, got %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestServerStrictProtocol(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte{socks5Version, 1, byte(noAuth)})
+			io.ReadFull(client, make([]byte, 2))
+			client.Write([]byte{socks5Version, byte(ConnectCommand), 0x01, ipv4Address, 127, 0, 0, 1, 0, 80})
+			io.Copy(ioutil.Discard, client)
+		}()
+
+		proxy := NewServer()
+		proxy.StrictProtocol = strict
+		_, err := proxy.handshake(context.Background(), server)
+		server.Close()
+		client.Close()
+		if strict && !errors.Is(err, ErrProtocolViolation) {
+			t.Fatalf("want %v, got %v", ErrProtocolViolation, err)
+		}
+		if !strict && err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServerStrictProtocolAssociate(t *testing.T) {
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packet.Close()
+	go func() {
+		var buf [maxUdpPacket]byte
+		for {
+			n, addr, err := packet.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			_, err = packet.WriteTo(buf[:n], addr)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, strict := range []bool{false, true} {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listen.Close()
+
+		proxy := NewServer()
+		proxy.StrictProtocol = strict
+		go proxy.Serve(listen)
+
+		dial, err := NewDialer("socks5://" + listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dial.Dial("udp", packet.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		udpConn := conn.(*UDPConn)
+		udpConn.prefix = []byte{1, 0, 0}
+		_, err = udpConn.Write([]byte("reserved"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		udpConn.prefix = []byte{0, 0, 0}
+		_, err = udpConn.Write([]byte("zero"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The datagram with a reserved byte set is dropped in strict
+		// mode only, and the association keeps relaying the others.
+		want := []string{"reserved", "zero"}
+		if strict {
+			want = want[1:]
+		}
+		got := make([]byte, 16)
+		for _, w := range want {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got[:n]) != w {
+				t.Fatalf("strict %v: want %q, got %q", strict, w, got[:n])
+			}
+		}
+	}
+}
+
+func TestServerOnError(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	phases := make(chan string, 1)
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	proxy.OnError = func(ctx context.Context, phase string, conn net.Conn, err error) {
+		phases <- phase
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://u:x@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err == nil {
+		t.Fatal("want authentication error")
+	}
+
+	select {
+	case phase := <-phases:
+		if phase != "auth" {
+			t.Fatalf("want phase auth, got %s", phase)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnError not called")
+	}
+}
+
+type testSlogLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testSlogLogger) log(msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+}
+
+func (l *testSlogLogger) DebugContext(ctx context.Context, msg string, args ...interface{}) {
+	l.log(msg)
+}
+
+func (l *testSlogLogger) InfoContext(ctx context.Context, msg string, args ...interface{}) {
+	l.log(msg)
+}
+
+func (l *testSlogLogger) WarnContext(ctx context.Context, msg string, args ...interface{}) {
+	l.log(msg)
+}
+
+func (l *testSlogLogger) ErrorContext(ctx context.Context, msg string, args ...interface{}) {
+	l.log(msg)
+}
+
+func TestServerSlog(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	logger := &testSlogLogger{}
+	proxy := NewServer()
+	proxy.Slog = logger
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: dial.DialContext,
+	}
+	resp, err := cli.Get(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cli.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	proxy.Shutdown(ctx)
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	want := []string{"connection accepted", "authenticated", "dial", "tunnel closed"}
+	if strings.Join(logger.msgs, ",") != strings.Join(want, ",") {
+		t.Fatalf("want %v, got %v", want, logger.msgs)
+	}
+}
+
+func TestServerCancelDialOnClientClose(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	dialing := make(chan struct{})
+	canceled := make(chan struct{})
+	proxy := NewServer()
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		close(dialing)
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.proxyDial(context.Background(), dial.ProxyNetwork, dial.ProxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dial.connectAuth(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte{socks5Version, byte(ConnectCommand), 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeAddrWithStr(conn, testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-dialing
+	conn.Close()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("dial not canceled")
+	}
+}
+
+func TestServerDialTimeout(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.DialTimeout = time.Second / 10
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code() != TTLExpiredReply {
+		t.Fatalf("want %v, got %v", TTLExpiredReply, err)
+	}
+}
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	client, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listen.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestDrainTunnel(t *testing.T) {
+	for _, drain := range []time.Duration{0, time.Second} {
+		client, proxyClient := net.Pipe()
+		proxyTarget, target := net.Pipe()
+		defer client.Close()
+		defer target.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			drainTunnel(ctx, proxyTarget, proxyClient, make([]byte, 1024), make([]byte, 1024), drain)
+			close(done)
+		}()
+
+		// The pipe is synchronous, so the tunnel holds the bytes
+		// once Write returns, blocked writing them to target.
+		_, err := client.Write([]byte("in flight"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+
+		target.SetDeadline(time.Now().Add(time.Second))
+		got, _ := ioutil.ReadAll(target)
+		if drain > 0 && string(got) != "in flight" {
+			t.Fatalf("drain %v: want %q, got %q", drain, "in flight", got)
+		}
+		if drain == 0 && len(got) != 0 {
+			t.Fatalf("drain %v: want nothing, got %q", drain, got)
+		}
+		<-done
+	}
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	client, proxyClient := tcpPair(t)
+	proxyTarget, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	go tunnel(context.Background(), proxyTarget, &prefixConn{Conn: proxyClient}, make([]byte, 1024), make([]byte, 1024))
+
+	_, err := client.Write([]byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.(*net.TCPConn).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target.SetDeadline(time.Now().Add(time.Second))
+	got, err := ioutil.ReadAll(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "request" {
+		t.Fatalf("want %q, got %q", "request", got)
+	}
+	_, err = target.Write([]byte("response"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	got, err = ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "response" {
+		t.Fatalf("want %q, got %q", "response", got)
+	}
+}
+
+func TestServeConnContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dialCtx := make(chan context.Context, 1)
+	proxy := NewServer()
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		dialCtx <- ctx
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	done := make(chan struct{})
+	go func() {
+		proxy.ServeConnContext(ctx, server)
+		close(done)
+	}()
+
+	go func() {
+		dial := &Dialer{}
+		dial.connectAuth(client)
+		dial.connectCommand(client, ConnectCommand, testServer.Listener.Addr().String())
+		client.Close()
+	}()
+
+	<-dialCtx
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ServeConnContext not canceled")
+	}
+}
+
+func TestServerAdvertisedAddr(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	advertised := net.IPv4(203, 0, 113, 1)
+	proxy := NewServer()
+	proxy.AdvertisedAddr = func(local net.Addr) net.Addr {
+		addr := *local.(*net.TCPAddr)
+		addr.IP = advertised
+		return &addr
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.proxyDial(context.Background(), dial.ProxyNetwork, dial.ProxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = dial.connectAuth(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := dial.connectCommand(conn, ConnectCommand, testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.(*Address).IP.Equal(advertised) {
+		t.Fatalf("want %v, got %v", advertised, addr)
+	}
+}
+
+func TestAssociateReplyAddr(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.PacketForwardAddress = func(ctx context.Context, destinationAddr string, packet net.PacketConn, conn net.Conn) (net.IP, int, error) {
+		return net.IPv4zero, packet.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.proxyDial(context.Background(), dial.ProxyNetwork, dial.ProxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = dial.connectAuth(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := dial.connectCommand(conn, AssociateCommand, ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := addr.(*Address).IP; ip.IsUnspecified() {
+		t.Fatalf("want a reachable address, got %v", addr)
+	}
+
+	proxy.UDPAdvertisedIP = net.IPv4(203, 0, 113, 1)
+	conn2, err := dial.proxyDial(context.Background(), dial.ProxyNetwork, dial.ProxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	err = dial.connectAuth(conn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err = dial.connectCommand(conn2, AssociateCommand, ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := addr.(*Address).IP; !ip.Equal(proxy.UDPAdvertisedIP) {
+		t.Fatalf("want %v, got %v", proxy.UDPAdvertisedIP, addr)
+	}
+}
+
+type emptyBytesPool struct{}
+
+func (emptyBytesPool) Get() []byte { return nil }
+func (emptyBytesPool) Put([]byte)  {}
+
+func TestServerGetBuffer(t *testing.T) {
+	proxy := NewServer()
+	buf, err := proxy.getBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != defaultBufferSize {
+		t.Fatalf("want %d, got %d", defaultBufferSize, len(buf))
+	}
+
+	proxy.BufferSize = 1024
+	buf, err = proxy.getBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 1024 {
+		t.Fatalf("want %d, got %d", 1024, len(buf))
+	}
+
+	proxy.BytesPool = emptyBytesPool{}
+	_, err = proxy.getBuffer()
+	if err != errEmptyBuffer {
+		t.Fatalf("want %v, got %v", errEmptyBuffer, err)
+	}
+}
+
+func TestServerEmptyBytesPoolReply(t *testing.T) {
+	proxy := NewServer()
+	proxy.BytesPool = emptyBytesPool{}
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	_, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code() != ServerFailureReply {
+		t.Fatalf("want %v, got %v", ServerFailureReply, err)
+	}
+}
+
+func TestServerOnConnect(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	var allow int32
+	proxy := NewServer()
+	proxy.OnConnect = func(ctx context.Context, conn net.Conn) (net.Conn, error) {
+		if atomic.LoadInt32(&allow) == 0 {
+			return nil, errors.New("denied")
+		}
+		return &prefixConn{Conn: conn}, nil
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err == nil {
+		t.Fatal("want connection closed")
+	}
+
+	atomic.StoreInt32(&allow, 1)
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestServerOnConnectNil(t *testing.T) {
+	proxy := NewServer()
+	proxy.OnConnect = func(ctx context.Context, conn net.Conn) (net.Conn, error) {
+		return nil, nil
+	}
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+	v2 = append(v2, 192, 0, 2, 1, 192, 0, 2, 2, 0x30, 0x39, 0x04, 0x38)
+	headers := map[string][]byte{
+		"v1": []byte("PROXY TCP4 192.0.2.1 192.0.2.2 12345 1080\r\n"),
+		"v2": v2,
+	}
+	for name, header := range headers {
+		t.Run(name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+
+			remoteAddr := make(chan net.Addr, 1)
+			proxy := NewServer()
+			proxy.ProxyProtocol = true
+			proxy.Rules = RuleSetFunc(func(ctx context.Context, req *Request) bool {
+				remoteAddr <- req.RemoteAddr
+				return false
+			})
+			go proxy.ServeConn(server, nil)
+
+			go func() {
+				client.Write(header)
+				dial := &Dialer{}
+				dial.connectAuth(client)
+				dial.connectCommand(client, ConnectCommand, testServer.Listener.Addr().String())
+				client.Close()
+			}()
+
+			select {
+			case addr := <-remoteAddr:
+				if addr.String() != "192.0.2.1:12345" {
+					t.Fatalf("want 192.0.2.1:12345, got %v", addr)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("request not received")
+			}
+		})
+	}
+}
+
+func TestReadProxyProtocolInvalid(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("\x05\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+	_, err := readProxyProtocol(server)
+	if err != errInvalidProxyProtocol {
+		t.Fatalf("want %v, got %v", errInvalidProxyProtocol, err)
+	}
+}
+
+func TestServerServeTLS(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	remoteAddr := make(chan net.Addr, 1)
+	proxy := NewServer()
+	proxy.HandshakeTimeout = time.Second
+	proxy.Rules = RuleSetFunc(func(ctx context.Context, req *Request) bool {
+		remoteAddr <- req.RemoteAddr
+		return true
+	})
+	go proxy.ServeTLS(listen, tlsServer.TLS)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		var d tls.Dialer
+		d.Config = &tls.Config{InsecureSkipVerify: true}
+		return d.DialContext(ctx, network, address)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: dial.DialContext,
+	}
+	resp, err := cli.Get(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	addr := <-remoteAddr
+	if _, ok := addr.(*net.TCPAddr); !ok {
+		t.Fatalf("want *net.TCPAddr, got %T", addr)
+	}
+}
+
+func TestServerEnabledCommands(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.EnabledCommands = []Command{ConnectCommand}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := dial.Listen(context.Background(), "tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.Accept()
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("want *ReplyError, got %v", err)
+	}
+	if replyErr.Code() != CommandNotSupportedReply {
+		t.Fatalf("want code %d, got %d", CommandNotSupportedReply, replyErr.Code())
+	}
+
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestServerRewrite(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	target := testServer.Listener.Addr().(*net.TCPAddr)
+	proxy := NewServer()
+	proxy.Rewrite = func(ctx context.Context, req *Request) (*Address, error) {
+		if req.DestinationAddr.Name == "denied.internal" {
+			return nil, errors.New("denied")
+		}
+		return &Address{IP: target.IP, Port: target.Port}, nil
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: dial.DialContext,
+	}
+	resp, err := cli.Get("http://backend.internal/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	_, err = dial.Dial("tcp", "denied.internal:80")
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("want *ReplyError, got %v", err)
+	}
+}
+
+func TestServerInvalidDestination(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range []string{"0.0.0.0:80", "[::]:80", testServer.Listener.Addr().(*net.TCPAddr).IP.String() + ":0"} {
+		_, err = dial.Dial("tcp", address)
+		var replyErr *ReplyError
+		if !errors.As(err, &replyErr) {
+			t.Fatalf("%s: want *ReplyError, got %v", address, err)
+		}
+		if replyErr.Code() != HostUnreachableReply {
+			t.Fatalf("%s: want code %d, got %d", address, HostUnreachableReply, replyErr.Code())
+		}
+	}
+}
+
+func TestReadWriteAddr(t *testing.T) {
+	addrs := []*Address{
+		{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 1080},
+		{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		{Name: "example.com", Port: 80},
+	}
+	for _, addr := range addrs {
+		var buf bytes.Buffer
+		err := WriteAddr(&buf, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadAddr(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != addr.String() {
+			t.Fatalf("want %v, got %v", addr, got)
+		}
+	}
+
+	_, err := ReadAddr(bytes.NewReader([]byte{0x02, 0, 0}))
+	if !errors.Is(err, ErrUnrecognizedAddrType) {
+		t.Fatalf("want %v, got %v", ErrUnrecognizedAddrType, err)
+	}
+	_, err = ReadAddr(bytes.NewReader([]byte{fqdnAddress, 0, 0, 80}))
+	if !errors.Is(err, errEmptyName) {
+		t.Fatalf("want %v, got %v", errEmptyName, err)
+	}
+	_, err = ReadAddr(bytes.NewReader([]byte{ipv6Address, 0, 0, 0, 0}))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("want %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := proxy.Stats(); stats.ActiveConnections != 1 || stats.TotalConnections != 1 {
+		t.Fatalf("want 1 active and 1 total connection, got %+v", stats)
+	}
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for proxy.Stats().ActiveConnections != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := proxy.Stats()
+	if stats.TotalConnections != 1 || stats.BytesSent == 0 || stats.BytesReceived == 0 {
+		t.Fatalf("want traffic of 1 connection, got %+v", stats)
+	}
+
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packet.Close()
+	go func() {
+		var buf [maxUdpPacket]byte
+		n, addr, err := packet.ReadFrom(buf[:])
+		if err != nil {
+			return
+		}
+		packet.WriteTo(buf[:n], addr)
+	}()
+	// Closing the UDPConn leaves the control connection open.
+	var control net.Conn
+	dial.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		c, err := net.Dial(network, address)
+		control = c
+		return c, err
+	}
+	conn, err = dial.Dial("udp", packet.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	control.Close()
+
+	deadline = time.Now().Add(time.Second)
+	for proxy.Stats().ActiveConnections != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("association not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The association adds the payloads of its datagrams.
+	got := proxy.Stats()
+	if got.BytesSent != stats.BytesSent+5 || got.BytesReceived != stats.BytesReceived+5 {
+		t.Fatalf("want 5 more bytes each way than %+v, got %+v", stats, got)
+	}
+}
+
+func TestServerNoAcceptableMethods(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	errs := make(chan error, 2)
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	proxy.OnError = func(ctx context.Context, phase string, conn net.Conn, err error) {
+		if phase != "auth" {
+			t.Errorf("want phase auth, got %s", phase)
+		}
+		errs <- err
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err == nil {
+		t.Fatal("want authentication error")
+	}
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrNoSupportedAuth) {
+			t.Fatalf("want %v, got %v", ErrNoSupportedAuth, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnError not called")
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("OnError called again with %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := proxy.Stats().NoAcceptableMethods; n != 1 {
+		t.Fatalf("want 1 client without acceptable methods, got %d", n)
+	}
+}
+
+func TestStaticCredentials(t *testing.T) {
+	creds, err := ReadCredentials(strings.NewReader("# users\nalice:secret\n\nbob:pa:ss\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		username, password string
+		want               bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "pa:ss", true},
+		{"carol", "", false},
+		{"carol", "secret", false},
+	}
+	for _, tt := range tests {
+		if got := creds.Auth(ConnectCommand, tt.username, tt.password); got != tt.want {
+			t.Errorf("Auth(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+	}
+
+	_, err = ReadCredentials(strings.NewReader("alice\n"))
+	if err == nil {
+		t.Fatal("want invalid credentials error")
+	}
+}
+
+func TestServerAuthenticatorContext(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	remoteAddr := make(chan net.Addr, 1)
+	proxy := NewServer()
+	proxy.Authentication = AuthenticatorContextFunc(func(ctx context.Context, info AuthInfo) bool {
+		remoteAddr <- info.RemoteAddr
+		return info.Username == "u" && info.Password == "p"
+	})
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://u:p@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	addr := <-remoteAddr
+	if addr.String() != conn.LocalAddr().String() {
+		t.Fatalf("want client address, got %v", addr)
+	}
+}
+
+func TestServerAuthLimiter(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	proxy.AuthLimiter = NewAuthLimiter(2, time.Minute)
+	go proxy.Serve(listen)
+
+	bad, err := NewDialer("socks5://u:x@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := NewDialer("socks5://u:p@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := good.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	for i := 0; i < 2; i++ {
+		_, err = bad.Dial("tcp", testServer.Listener.Addr().String())
+		if err == nil {
+			t.Fatal("want authentication error")
+		}
+	}
+	_, err = good.Dial("tcp", testServer.Listener.Addr().String())
+	if err == nil {
+		t.Fatal("want client blocked")
+	}
+}
+
+func TestAuthLimiterWindow(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	other := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2}
+	limiter := NewAuthLimiter(1, 50*time.Millisecond)
+	limiter.Failure(addr)
+	if limiter.Allow(other) {
+		t.Fatal("want client IP blocked")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !limiter.Allow(addr) {
+		t.Fatal("want client IP allowed after window")
+	}
+	limiter.Failure(addr)
+	limiter.Success(addr)
+	if !limiter.Allow(addr) {
+		t.Fatal("want client IP allowed after success")
+	}
+}
+
+func TestServerTunnelCancel(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proxy := NewServer()
+	done := make(chan struct{})
+	go func() {
+		proxy.ServeConnContext(ctx, server)
+		close(done)
+	}()
+
+	dial := &Dialer{}
+	err = dial.connectAuth(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.connectCommand(client, ConnectCommand, target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("tunnel not canceled")
+	}
+	_, err = client.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("want client connection closed")
+	}
+}
+
+func TestServerRulesReply(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	const privateReply Reply = 0x88
+	proxy := NewServer()
+	proxy.Rules = ReplyRuleSetFunc(func(ctx context.Context, req *Request) Reply {
+		return privateReply
+	})
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("want *ReplyError, got %v", err)
+	}
+	if replyErr.Code() != privateReply {
+		t.Fatalf("want code %d, got %d", privateReply, replyErr.Code())
+	}
+}
+
+func TestServerFallbackDelay(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.FallbackDelay = 10 * time.Millisecond
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(testServer.Listener.Addr().String())
+	conn, err := dial.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestServerRequestLimiter(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.RequestLimiter = NewRequestLimiter(1, 2)
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err == nil {
+		t.Fatal("want connection closed")
+	}
+}
+
+func TestRequestLimiterRefill(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	other := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1}
+	limiter := NewRequestLimiter(20, 1)
+	if !limiter.Allow(addr) {
+		t.Fatal("want first request allowed")
+	}
+	if limiter.Allow(addr) {
+		t.Fatal("want second request limited")
+	}
+	if !limiter.Allow(other) {
+		t.Fatal("want other client allowed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !limiter.Allow(addr) {
+		t.Fatal("want request allowed after refill")
+	}
+}
+
+func TestServerLocalIP(t *testing.T) {
+	localIP := net.IPv4(127, 0, 0, 2)
+	probe, err := net.Listen("tcp", net.JoinHostPort(localIP.String(), "0"))
+	if err != nil {
+		t.Skip(err)
+	}
+	probe.Close()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	remoteAddr := make(chan net.Addr, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		remoteAddr <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.LocalIP = localIP
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	addr := (<-remoteAddr).(*net.TCPAddr)
+	if !addr.IP.Equal(localIP) {
+		t.Fatalf("want source %v, got %v", localIP, addr.IP)
+	}
+}
+
+func TestServerControl(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	controlled := make(chan string, 1)
+	proxy := NewServer()
+	proxy.Control = func(network, address string, c syscall.RawConn) error {
+		controlled <- address
+		return nil
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if address := <-controlled; address != testServer.Listener.Addr().String() {
+		t.Fatalf("want %s, got %s", testServer.Listener.Addr(), address)
+	}
+}
+
+func TestServerBindControl(t *testing.T) {
+	controlled := make(chan string, 1)
+	proxy := NewServer()
+	proxy.LocalIP = net.IPv4(127, 0, 0, 1)
+	proxy.Control = func(network, address string, c syscall.RawConn) error {
+		controlled <- address
+		return nil
+	}
+	conn := proxy.Pipe()
+	defer conn.Close()
+
+	go conn.Write([]byte{
+		socks5Version, 1, byte(noAuth),
+		socks5Version, byte(BindCommand), 0, ipv4Address, 0, 0, 0, 0, 0, 0,
+	})
+	var method [2]byte
+	_, err := io.ReadFull(conn, method[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header [3]byte
+	_, err = io.ReadFull(conn, header[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != [3]byte{socks5Version, byte(SuccessReply), 0} {
+		t.Fatalf("want success reply, got %v", header)
+	}
+	bound, err := ReadAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bound.IP.Equal(proxy.LocalIP) {
+		t.Fatalf("want BIND on %v, got %v", proxy.LocalIP, bound)
+	}
+	select {
+	case address := <-controlled:
+		if address != "127.0.0.1:0" {
+			t.Fatalf("want 127.0.0.1:0, got %s", address)
+		}
+	default:
+		t.Fatal("want Control called for the BIND listener")
+	}
+}
+
+func TestServerNonTCPTarget(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("want *ReplyError, got %v", err)
+	}
+	if replyErr.Code() != ServerFailureReply {
+		t.Fatalf("want code %d, got %d", ServerFailureReply, replyErr.Code())
+	}
+}
+
+func TestErrToReply(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	tests := []struct {
+		err  error
+		want Reply
+	}{
+		{nil, SuccessReply},
+		{NewReplyError(TTLExpiredReply), TTLExpiredReply},
+		{opErr(syscall.ECONNREFUSED), ConnectionRefusedReply},
+		{opErr(syscall.ENETUNREACH), NetworkUnreachableReply},
+		{opErr(syscall.EHOSTUNREACH), HostUnreachableReply},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}, HostUnreachableReply},
+		{fmt.Errorf("connect to x failed: %w", opErr(syscall.ECONNREFUSED)), ConnectionRefusedReply},
+		{errors.New("connection refused"), ConnectionRefusedReply},
+		{errors.New("other"), HostUnreachableReply},
+	}
+	for _, tt := range tests {
+		if got := errToReply(tt.err); got != tt.want {
+			t.Errorf("errToReply(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func ExampleServer_Pipe() {
+	proxy := NewServer()
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		target, conn := net.Pipe()
+		go func() {
+			defer conn.Close()
+			conn.Write([]byte("hello " + address))
+		}()
+		return target, nil
+	}
+	// net.Pipe has no TCP address to send in the reply.
+	proxy.AdvertisedAddr = func(local net.Addr) net.Addr {
+		return &net.TCPAddr{IP: net.IPv4zero}
+	}
+
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	conn, err := dial.Dial("tcp", "example.com:80")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer conn.Close()
+	msg, _ := ioutil.ReadAll(conn)
+	fmt.Println(string(msg))
+	// Output: hello example.com:80
+}
+
+func TestServerConnContext(t *testing.T) {
+	type traceKey struct{}
+	traces := make(chan interface{}, 1)
+	proxy := NewServer()
+	proxy.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		return context.WithValue(ctx, traceKey{}, "trace-1")
+	}
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		traces <- ctx.Value(traceKey{})
+		return nil, errors.New("connection refused")
+	}
+
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	_, err := dial.Dial("tcp", "example.com:80")
+	if err == nil {
+		t.Fatal("want dial error")
+	}
+	if trace := <-traces; trace != "trace-1" {
+		t.Fatalf("want trace-1, got %v", trace)
+	}
+}
+
+func TestServerFallback(t *testing.T) {
+	proxy := NewServer()
+	proxy.Fallback = func(ctx context.Context, conn net.Conn) error {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write([]byte("HTTP/1.0 200 OK\r\n\r\n" + req.URL.Path))
+		return err
+	}
+
+	conn := proxy.Pipe()
+	defer conn.Close()
+	go conn.Write([]byte("GET /fallback HTTP/1.0\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "/fallback" {
+		t.Fatalf("want /fallback, got %q", body)
+	}
+
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	_, err = dial.Dial("tcp", "127.0.0.1:0")
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("want SOCKS5 served, got %v", err)
+	}
+}
+
+func TestServerSOCKS4(t *testing.T) {
+	proxy := NewServer()
+	proxy.AllowSOCKS4 = true
+
+	target := testServer.Listener.Addr().(*net.TCPAddr)
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], uint16(target.Port))
+	requests := map[string][]byte{
+		"socks4":  append(append([]byte{4, 1}, port[:]...), append(target.IP.To4(), []byte("user\x00")...)...),
+		"socks4a": append(append([]byte{4, 1}, port[:]...), []byte("\x00\x00\x00\x01user\x00localhost\x00")...),
+	}
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			conn := proxy.Pipe()
+			defer conn.Close()
+			go conn.Write(append(request, "GET / HTTP/1.0\r\n\r\n"...))
+
+			var reply [8]byte
+			_, err := io.ReadFull(conn, reply[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply[0] != 0 || reply[1] != socks4Granted {
+				t.Fatalf("want request granted, got %v", reply)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != "ok" {
+				t.Fatalf("want ok, got %q", body)
+			}
+		})
+	}
+}
+
+func TestServerSOCKS4RequiresNoAuth(t *testing.T) {
+	proxy := NewServer()
+	proxy.AllowSOCKS4 = true
+	proxy.Authentication = UserAuth("u", "p")
+
+	conn := proxy.Pipe()
+	defer conn.Close()
+	go conn.Write([]byte("\x04\x01\x00\x50\x7f\x00\x00\x01\x00"))
+
+	var reply [8]byte
+	_, err := io.ReadFull(conn, reply[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks4Rejected {
+		t.Fatalf("want request rejected, got %v", reply)
+	}
+}
+
+func TestServerSOCKS4AdvertisedAddr(t *testing.T) {
+	tests := []struct {
+		name  string
+		addr  net.Addr
+		reply byte
+		want  [6]byte
+	}{
+		{"ip", &Address{IP: net.IPv4(192, 0, 2, 1), Port: 1080}, socks4Granted, [6]byte{0x04, 0x38, 192, 0, 2, 1}},
+		{"name", &Address{Name: "proxy.example", Port: 1080}, socks4Rejected, [6]byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := NewServer()
+			proxy.AllowSOCKS4 = true
+			proxy.AdvertisedAddr = func(local net.Addr) net.Addr {
+				return tt.addr
+			}
+			conn := proxy.Pipe()
+			defer conn.Close()
+
+			var port [2]byte
+			binary.BigEndian.PutUint16(port[:], uint16(testServer.Listener.Addr().(*net.TCPAddr).Port))
+			go conn.Write(append(append([]byte{4, 1}, port[:]...), 127, 0, 0, 1, 0))
+
+			var reply [8]byte
+			_, err := io.ReadFull(conn, reply[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply[1] != tt.reply {
+				t.Fatalf("want reply %v, got %v", tt.reply, reply)
+			}
+			if !bytes.Equal(reply[2:], tt.want[:]) {
+				t.Fatalf("want address %v, got %v", tt.want, reply[2:])
+			}
+		})
+	}
+}
+
+func TestServerBindReplies(t *testing.T) {
+	proxy := NewServer()
+	conn := proxy.Pipe()
+	defer conn.Close()
+
+	go conn.Write([]byte{
+		socks5Version, 1, byte(noAuth),
+		socks5Version, byte(BindCommand), 0, ipv4Address, 127, 0, 0, 1, 0, 0,
+	})
+	var method [2]byte
+	_, err := io.ReadFull(conn, method[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readReply := func() *Address {
+		var header [3]byte
+		_, err := io.ReadFull(conn, header[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != [3]byte{socks5Version, byte(SuccessReply), 0} {
+			t.Fatalf("want success reply, got %v", header)
+		}
+		addr, err := ReadAddr(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+
+	bound := readReply()
+	if !bound.IP.Equal(net.IPv4(127, 0, 0, 1)) || bound.Port == 0 {
+		t.Fatalf("want the bound address in the first reply, got %v", bound)
+	}
+	peer, err := net.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if got := readReply(); got.String() != peer.LocalAddr().String() {
+		t.Fatalf("want the peer address %v in the second reply, got %v", peer.LocalAddr(), got)
+	}
+}
+
+func TestServerDeniedNetworks(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	proxy := NewServer()
+	proxy.DeniedNetworks = []*net.IPNet{loopback}
+	proxy.Resolver = NameResolverFunc(func(ctx context.Context, name string) (net.IP, error) {
+		return net.IPv4(127, 0, 0, 1), nil
+	})
+
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	_, port, _ := net.SplitHostPort(testServer.Listener.Addr().String())
+	for _, host := range []string{"127.0.0.1", "backend.internal"} {
+		_, err := dial.Dial("tcp", net.JoinHostPort(host, port))
+		var replyErr *ReplyError
+		if !errors.As(err, &replyErr) {
+			t.Fatalf("%s: want *ReplyError, got %v", host, err)
+		}
+		if replyErr.Code() != RuleFailureReply {
+			t.Fatalf("%s: want code %d, got %d", host, RuleFailureReply, replyErr.Code())
+		}
+	}
+
+	proxy.DeniedNetworks = nil
+	proxy.AllowedNetworks = []*net.IPNet{loopback}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestServerBlockPrivateDestinations(t *testing.T) {
+	proxy := NewServer()
+	proxy.BlockPrivateDestinations = true
+
+	for _, ip := range []string{"127.0.0.1", "169.254.169.254", "10.1.2.3", "::1", "fe80::1", "::ffff:192.168.1.1"} {
+		if proxy.allowedIP(net.ParseIP(ip)) {
+			t.Errorf("want %s blocked", ip)
+		}
+	}
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		if !proxy.allowedIP(net.ParseIP(ip)) {
+			t.Errorf("want %s allowed", ip)
+		}
+	}
+
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	_, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code() != RuleFailureReply {
+		t.Fatalf("want code %d, got %v", RuleFailureReply, err)
+	}
+
+	_, linkLocal, _ := net.ParseCIDR("169.254.0.0/16")
+	proxy.PrivateNetworks = []*net.IPNet{linkLocal}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+type testTemporaryError struct{}
+
+func (testTemporaryError) Error() string   { return "temporary failure" }
+func (testTemporaryError) Timeout() bool   { return false }
+func (testTemporaryError) Temporary() bool { return true }
+
+func TestServerDialRetries(t *testing.T) {
+	var attempts int
+	proxy := NewServer()
+	proxy.DialRetries = 2
+	proxy.DialRetryBackoff = time.Millisecond
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		attempts++
+		if attempts <= 2 {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: testTemporaryError{}}
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if attempts != 3 {
+		t.Fatalf("want 3 attempts, got %d", attempts)
+	}
+
+	attempts = 0
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		attempts++
+		return nil, errors.New("connection refused")
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err == nil {
+		t.Fatal("want dial error")
+	}
+	if attempts != 1 {
+		t.Fatalf("want permanent errors not retried, got %d attempts", attempts)
+	}
+}
+
+func TestRequestAuthMethod(t *testing.T) {
+	methods := make(chan byte, 1)
+	proxy := NewServer()
+	proxy.AuthMethods = []AuthMethod{UserAuthMethod(UserAuth("u", "p")), NoAuthMethod()}
+	proxy.Rules = RuleSetFunc(func(ctx context.Context, req *Request) bool {
+		methods <- req.AuthMethod
+		return req.Command != BindCommand || req.AuthMethod == byte(userAuth)
+	})
+
+	for _, tt := range []struct {
+		username string
+		want     authMethod
+	}{
+		{"", noAuth},
+		{"u", userAuth},
+	} {
+		dial := &Dialer{
+			Username: tt.username,
+			Password: "p",
+			ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return proxy.Pipe(), nil
+			},
+		}
+		conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if got := <-methods; got != byte(tt.want) {
+			t.Fatalf("want method %d, got %d", tt.want, got)
+		}
+	}
+}
+
+func TestUDPMaxPacketSize(t *testing.T) {
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packet.Close()
+	go func() {
+		var buf [maxUdpPacket]byte
+		for {
+			n, addr, err := packet.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			_, err = packet.WriteTo(buf[:n], addr)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.MaxUDPPacketSize = 512
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("udp", packet.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(make([]byte, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("small")
+	_, err = conn.Write(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 1024)
+	n, err := conn.Read(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got[:n]) {
+		t.Fatalf("want %q, got %q", want, got[:n])
+	}
+	if dropped := proxy.Stats().UDPPacketsTooLarge; dropped != 1 {
+		t.Fatalf("want 1 datagram dropped, got %d", dropped)
+	}
+}
+
+func TestUDPAssociateFamilies(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		control string
+		request *Address
+	}{
+		{"ipv4", "udp4", "127.0.0.1:0", &Address{IP: net.IPv6unspecified}},
+		{"ipv6", "udp6", "[::1]:0", &Address{IP: net.IPv4zero.To4()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listen, err := net.Listen("tcp", tt.control)
+			if err != nil {
+				t.Skip(err)
+			}
+			defer listen.Close()
+			packet, err := net.ListenPacket(tt.network, tt.control)
+			if err != nil {
+				t.Skip(err)
+			}
+			defer packet.Close()
+			go func() {
+				var buf [maxUdpPacket]byte
+				n, addr, err := packet.ReadFrom(buf[:])
+				if err != nil {
+					return
+				}
+				packet.WriteTo(buf[:n], addr)
+			}()
+
+			proxy := NewServer()
+			go proxy.Serve(listen)
+
+			control, err := net.Dial("tcp", listen.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer control.Close()
+			var request bytes.Buffer
+			request.Write([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(AssociateCommand), 0})
+			WriteAddr(&request, tt.request)
+			_, err = control.Write(request.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var header [5]byte
+			_, err = io.ReadFull(control, header[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header[3] != byte(SuccessReply) {
+				t.Fatalf("want success reply, got %v", header)
+			}
+			bound, err := ReadAddr(control)
+			if err != nil {
+				t.Fatal(err)
+			}
+			controlIP := control.LocalAddr().(*net.TCPAddr).IP
+			if (bound.IP.To4() != nil) != (controlIP.To4() != nil) {
+				t.Fatalf("want an address of the family of %v, got %v", controlIP, bound)
+			}
+
+			relay, err := net.Dial(tt.network, bound.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer relay.Close()
+			var datagram bytes.Buffer
+			datagram.Write([]byte{0, 0, 0})
+			WriteAddr(&datagram, &Address{IP: packet.LocalAddr().(*net.UDPAddr).IP, Port: packet.LocalAddr().(*net.UDPAddr).Port})
+			datagram.WriteString("ping")
+			_, err = relay.Write(datagram.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			relay.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 1024)
+			n, err := relay.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(buf[:n], []byte("ping")) {
+				t.Fatalf("want ping, got %q", buf[:n])
+			}
+		})
+	}
+}
+
+func TestServerReplyWriteDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	proxy := NewServer()
+	proxy.HandshakeTimeout = 50 * time.Millisecond
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	done := make(chan struct{})
+	go func() {
+		proxy.ServeConnContext(context.Background(), server)
+		close(done)
+	}()
+
+	dial := &Dialer{}
+	err := dial.connectAuth(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Send the request without reading the reply.
+	var request bytes.Buffer
+	request.Write([]byte{socks5Version, byte(ConnectCommand), 0})
+	WriteAddr(&request, &Address{IP: net.IPv4(192, 0, 2, 1), Port: 80})
+	_, err = client.Write(request.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("server blocked on sending the reply")
+	}
+}
+
+func TestServerTunnel(t *testing.T) {
+	sizes := make(chan [2]int64, 1)
+	proxy := NewServer()
+	proxy.Tunnel = func(ctx context.Context, dst, src net.Conn) error {
+		// Upper-case the response of the destination.
+		go func() {
+			io.Copy(dst, src)
+		}()
+		buf, err := ioutil.ReadAll(dst)
+		if err != nil {
+			return err
+		}
+		_, err = src.Write(bytes.ToUpper(buf))
+		src.Close()
+		return err
+	}
+	proxy.OnConnClose = func(req *Request, sent, received int64, err error) {
+		sizes <- [2]int64{sent, received}
+	}
+
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET / HTTP/1.0\r\n\r\n"
+	_, err = conn.Write([]byte(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(resp, []byte("\r\n\r\nOK")) {
+		t.Fatalf("want transformed response, got %q", resp)
+	}
+	size := <-sizes
+	if size[0] != int64(len(request)) || size[1] != int64(len(resp)) {
+		t.Fatalf("want %d sent and %d received, got %v", len(request), len(resp), size)
+	}
+}
+
+func TestServerUDPPortRange(t *testing.T) {
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freePort := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+
+	tests := []struct {
+		name  string
+		port  int
+		reply Reply
+	}{
+		{"free", freePort, SuccessReply},
+		{"busy", busy.LocalAddr().(*net.UDPAddr).Port, ServerFailureReply},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listen, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listen.Close()
+
+			proxy := NewServer()
+			proxy.UDPPortRange = [2]int{tt.port, tt.port}
+			go proxy.Serve(listen)
+
+			control, err := net.Dial("tcp", listen.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer control.Close()
+			var request bytes.Buffer
+			request.Write([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(AssociateCommand), 0})
+			WriteAddr(&request, &Address{IP: net.IPv4zero.To4()})
+			_, err = control.Write(request.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var header [5]byte
+			_, err = io.ReadFull(control, header[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header[3] != byte(tt.reply) {
+				t.Fatalf("want reply %v, got %v", tt.reply, header)
+			}
+			if tt.reply != SuccessReply {
+				return
+			}
+			bound, err := ReadAddr(control)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bound.Port != tt.port {
+				t.Fatalf("want port %d, got %v", tt.port, bound)
+			}
+		})
+	}
+}
+
+func TestServerAuthMethodPriority(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods []AuthMethod
+		offered []byte
+		want    byte
+	}{
+		{"server order", []AuthMethod{UserAuthMethod(UserAuth("u", "p")), NoAuthMethod()}, []byte{byte(noAuth), byte(userAuth)}, byte(userAuth)},
+		{"only offered", []AuthMethod{UserAuthMethod(UserAuth("u", "p")), NoAuthMethod()}, []byte{byte(noAuth)}, byte(noAuth)},
+		{"none offered", []AuthMethod{UserAuthMethod(UserAuth("u", "p"))}, []byte{byte(noAuth)}, byte(noAcceptable)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+
+			proxy := NewServer()
+			proxy.AuthMethods = tt.methods
+			go proxy.ServeConnContext(context.Background(), server)
+
+			_, err := client.Write(append([]byte{socks5Version, byte(len(tt.offered))}, tt.offered...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reply [2]byte
+			_, err = io.ReadFull(client, reply[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply[1] != tt.want {
+				t.Fatalf("want method %d, got %d", tt.want, reply[1])
+			}
+		})
+	}
+}
+
+func TestServerOnAssociateClose(t *testing.T) {
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packet.Close()
+	go func() {
+		var buf [maxUdpPacket]byte
+		n, addr, err := packet.ReadFrom(buf[:])
+		if err != nil {
+			return
+		}
+		packet.WriteTo(buf[:n], addr)
+	}()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	started := make(chan *Request, 1)
+	closed := make(chan AssociateCounts, 1)
+	proxy := NewServer()
+	proxy.OnAssociate = func(req *Request) {
+		started <- req
+	}
+	proxy.OnAssociateClose = func(req *Request, counts AssociateCounts, err error) {
+		closed <- counts
+	}
+	go proxy.Serve(listen)
+
+	control, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	var request bytes.Buffer
+	request.Write([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(AssociateCommand), 0})
+	WriteAddr(&request, &Address{IP: net.IPv4zero.To4()})
+	_, err = control.Write(request.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header [5]byte
+	_, err = io.ReadFull(control, header[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound, err := ReadAddr(control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := <-started; req.Command != AssociateCommand {
+		t.Fatalf("want %v, got %v", AssociateCommand, req.Command)
+	}
+
+	relay, err := net.Dial("udp", bound.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	var datagram bytes.Buffer
+	datagram.Write([]byte{0, 0, 0})
+	WriteAddr(&datagram, &Address{IP: net.IPv4(127, 0, 0, 1).To4(), Port: packet.LocalAddr().(*net.UDPAddr).Port})
+	datagram.WriteString("ping")
+	_, err = relay.Write(datagram.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = relay.Read(make([]byte, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	control.Close()
+
+	select {
+	case counts := <-closed:
+		want := AssociateCounts{PacketsSent: 1, PacketsReceived: 1, BytesSent: 4, BytesReceived: 4}
+		if counts != want {
+			t.Fatalf("want %+v, got %+v", want, counts)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("association not closed")
+	}
+}
+
+func TestServerListen(t *testing.T) {
+	proxy := NewServer()
+	listen, err := proxy.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	if listen.Addr().(*net.TCPAddr).Port == 0 {
+		t.Fatalf("want a chosen port, got %v", listen.Addr())
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestServerPanicRecovery(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	phases := make(chan string, 1)
+	var panicked int32
+	proxy := NewServer()
+	proxy.ProxyDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if atomic.CompareAndSwapInt32(&panicked, 0, 1) {
+			panic("broken dialer")
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	proxy.OnError = func(ctx context.Context, phase string, conn net.Conn, err error) {
+		if phase == "panic" && strings.Contains(err.Error(), "broken dialer") {
+			phases <- phase
+		}
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err == nil {
+		t.Fatal("want an error from the panicking dialer")
+	}
+	select {
+	case <-phases:
+	case <-time.After(time.Second):
+		t.Fatal("panic not reported")
+	}
+
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestServerAllowedPorts(t *testing.T) {
+	_, port, _ := net.SplitHostPort(testServer.Listener.Addr().String())
+	allowed, _ := strconv.Atoi(port)
+	proxy := NewServer()
+	proxy.AllowedPorts = []int{allowed}
+
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	_, err = dial.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(allowed+1)))
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code() != RuleFailureReply {
+		t.Fatalf("want %v, got %v", RuleFailureReply, err)
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	drained := make(chan struct{})
+	proxy := NewServer()
+	proxy.OnDrained = func() {
+		close(drained)
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := proxy.ActiveConns(); n != 1 {
+		t.Fatalf("want 1 active connection, got %d", n)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- proxy.Shutdown(context.Background())
+	}()
+	select {
+	case <-drained:
+		t.Fatal("drained with an active connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("not drained")
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if n := proxy.ActiveConns(); n != 0 {
+		t.Fatalf("want no active connection, got %d", n)
+	}
+}
+
+func TestSetKeepAlive(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !setKeepAlive(&prefixConn{Conn: conn}, time.Minute) {
+		t.Fatal("want keep-alive set through a wrapping connection")
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if setKeepAlive(client, time.Minute) {
+		t.Fatal("want no keep-alive on a pipe")
+	}
+}
+
+func TestSetNoDelay(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !setNoDelay(&prefixConn{Conn: conn}, false) {
+		t.Fatal("want no delay set through a wrapping connection")
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if setNoDelay(client, false) {
+		t.Fatal("want no delay unset on a pipe")
+	}
+}
+
+func TestServerDisableNoDelay(t *testing.T) {
+	proxy := NewServer()
+	proxy.DisableNoDelay = true
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerInspectSNI(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listen.Close()
+		received := make(chan []byte, 1)
+		go func() {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 1)
+			n, _ := conn.Read(buf)
+			received <- buf[:n]
+		}()
+
+		names := make(chan string, 1)
+		proxy := NewServer()
+		proxy.InspectSNI = true
+		proxy.OnSNI = func(req *Request, serverName string) bool {
+			names <- serverName
+			return allow
+		}
+		dial := &Dialer{
+			ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return proxy.Pipe(), nil
+			},
+		}
+		conn, err := dial.Dial("tcp", listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		go tls.Client(conn, &tls.Config{ServerName: "example.test"}).Handshake()
+
+		if got := <-names; got != "example.test" {
+			t.Fatalf("want server name %q, got %q", "example.test", got)
+		}
+		got := <-received
+		if allow && (len(got) == 0 || got[0] != tlsHandshakeRecord) {
+			t.Fatalf("want the ClientHello forwarded, got %x", got)
+		}
+		if !allow && len(got) != 0 {
+			t.Fatalf("want nothing forwarded, got %x", got)
+		}
+		conn.Close()
+	}
+}
+
+func TestServerInspectSNIPlain(t *testing.T) {
+	proxy := NewServer()
+	proxy.InspectSNI = true
+	proxy.OnSNI = func(req *Request, serverName string) bool {
+		t.Errorf("unexpected server name %q", serverName)
+		return false
+	}
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	for _, cmd := range []Command{ConnectCommand, BindCommand, AssociateCommand} {
+		got, err := ParseCommand(cmd.String())
+		if err != nil || got != cmd {
+			t.Fatalf("%v: got %v, %v", cmd, got, err)
+		}
+	}
+	got, err := ParseCommand(" CONNECT ")
+	if err != nil || got != ConnectCommand {
+		t.Fatalf("want %v, got %v, %v", ConnectCommand, got, err)
+	}
+	_, err = ParseCommand("resolve")
+	if !errors.Is(err, ErrUnsupportedCommand) {
+		t.Fatalf("want %v, got %v", ErrUnsupportedCommand, err)
+	}
+}
+
+func TestServerRouter(t *testing.T) {
+	var routed int32
+	proxy := NewServer()
+	proxy.Router = RouterFunc(func(ctx context.Context, req *Request) ProxyDialFunc {
+		if req.DestinationAddr.Name != "routed.test" {
+			return nil
+		}
+		return func(ctx context.Context, network string, address string) (net.Conn, error) {
+			atomic.AddInt32(&routed, 1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, testServer.Listener.Addr().String())
+		}
+	})
+
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	conn, err := dial.Dial("tcp", "routed.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	conn, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := atomic.LoadInt32(&routed); n != 1 {
+		t.Fatalf("want 1 routed dial, got %d", n)
+	}
+}
+
+func TestUserAuthMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"empty username", []byte{userAuthVersion, 0, 1, 'p'}, errEmptyUsername},
+		{"truncated username", []byte{userAuthVersion, 5, 'u'}, io.ErrUnexpectedEOF},
+		{"truncated password", []byte{userAuthVersion, 1, 'u', 3, 'p'}, io.ErrUnexpectedEOF},
+		{"missing password", []byte{userAuthVersion, 1, 'u'}, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(tt.input)
+				client.Close()
+			}()
+			m := userAuthMethod{auth: UserAuth("u", "p")}
+			_, _, err := m.authenticate(context.Background(), server)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestServerUse(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, req *Request) error {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				if req.DestinationAddr.Port == 25 {
+					return NewReplyError(RuleFailureReply)
+				}
+				return next(ctx, req)
+			}
+		}
+	}
+	proxy := NewServer()
+	proxy.Use(record("outer"), record("inner"))
+
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	mu.Lock()
+	got := strings.Join(order, ",")
+	mu.Unlock()
+	if got != "outer,inner" {
+		t.Fatalf("want outer,inner, got %s", got)
+	}
+
+	_, err = dial.Dial("tcp", "127.0.0.1:25")
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code() != RuleFailureReply {
+		t.Fatalf("want %v, got %v", RuleFailureReply, err)
+	}
+}
+
+func TestServerStrictBindPeer(t *testing.T) {
+	expected := net.IPv4(127, 0, 0, 2).To4()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.StrictBindPeer = true
+	go proxy.Serve(listen)
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var request bytes.Buffer
+	request.Write([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(BindCommand), 0})
+	WriteAddr(&request, &Address{IP: expected, Port: 21})
+	_, err = conn.Write(request.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var method [2]byte
+	_, err = io.ReadFull(conn, method[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	readReply := func() *Address {
+		var header [3]byte
+		_, err := io.ReadFull(conn, header[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != [3]byte{socks5Version, byte(SuccessReply), 0} {
+			t.Fatalf("want success reply, got %v", header)
+		}
+		addr, err := ReadAddr(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+	bound := readReply()
+
+	intruder, err := net.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer intruder.Close()
+	intruder.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = intruder.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("want the intruder closed, got %v", err)
+	}
+
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: expected}}
+	peer, err := d.Dial("tcp", bound.String())
+	if err != nil {
+		t.Skip(err)
+	}
+	defer peer.Close()
+	if got := readReply(); got.String() != peer.LocalAddr().String() {
+		t.Fatalf("want the peer address %v in the second reply, got %v", peer.LocalAddr(), got)
+	}
+}
+
+func TestRequestFromContext(t *testing.T) {
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	usernames := make(chan string, 1)
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		req, ok := RequestFromContext(ctx)
+		if !ok {
+			return nil, errors.New("no request in context")
+		}
+		usernames <- req.Username
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+
+	dial, err := NewDialer("socks5://u:p@placeholder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return proxy.Pipe(), nil
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := <-usernames; got != "u" {
+		t.Fatalf("want username u, got %q", got)
+	}
+	if _, ok := RequestFromContext(context.Background()); ok {
+		t.Fatal("want no request in a background context")
+	}
+}
+
+func TestServerAdvertisedName(t *testing.T) {
+	tests := []struct {
+		name  string
+		addr  *Address
+		reply Reply
+	}{
+		{"name", &Address{Name: "proxy.example", Port: 1080}, SuccessReply},
+		{"too long", &Address{Name: strings.Repeat("a", 256), Port: 1080}, ServerFailureReply},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := NewServer()
+			proxy.AdvertisedAddr = func(local net.Addr) net.Addr {
+				return tt.addr
+			}
+			conn := proxy.Pipe()
+			defer conn.Close()
+
+			var request bytes.Buffer
+			request.Write([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(ConnectCommand), 0})
+			WriteAddr(&request, &Address{IP: net.IPv4(127, 0, 0, 1).To4(), Port: testServer.Listener.Addr().(*net.TCPAddr).Port})
+			go conn.Write(request.Bytes())
+
+			var header [5]byte
+			_, err := io.ReadFull(conn, header[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header[3] != byte(tt.reply) {
+				t.Fatalf("want reply %v, got %v", tt.reply, header)
+			}
+			if tt.reply != SuccessReply {
+				return
+			}
+			bound, err := ReadAddr(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bound.String() != tt.addr.String() {
+				t.Fatalf("want %v, got %v", tt.addr, bound)
+			}
+		})
+	}
+}
+
+func TestServerQuota(t *testing.T) {
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	proxy.Quota = NewQuota(4, 0)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	dial, err := NewDialer("socks5://u:p@placeholder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return proxy.Pipe(), nil
+	}
+	conn, err := dial.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for proxy.Quota.Check("u") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = dial.Dial("tcp", target.Addr().String())
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code() != RuleFailureReply {
+		t.Fatalf("want %v, got %v", RuleFailureReply, err)
+	}
+}
+
+func TestServerQuotaTunnel(t *testing.T) {
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	proxy.Quota = NewQuota(1024, 0)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	dial, err := NewDialer("socks5://u:p@placeholder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return proxy.Pipe(), nil
+	}
+	conn, err := dial.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// The tunnel is closed once the user goes over quota,
+	// not when the target stops writing.
+	n, err := io.Copy(ioutil.Discard, conn)
+	if isTimeoutError(err) {
+		t.Fatalf("want the tunnel closed over quota, got %v after %d bytes", err, n)
+	}
+	if n > 1024+defaultBufferSize {
+		t.Fatalf("want at most %d bytes, got %d", 1024+defaultBufferSize, n)
+	}
+}
+
+func TestQuotaPeriod(t *testing.T) {
+	q := NewQuota(10, 50*time.Millisecond)
+	q.Add("u", 6, 6)
+	if q.Check("u") {
+		t.Fatal("want u over quota")
+	}
+	if !q.Check("v") {
+		t.Fatal("want v within quota")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !q.Check("u") {
+		t.Fatal("want u within quota in a new period")
+	}
+}
+
+func TestUserFromContext(t *testing.T) {
+	for _, user := range []string{"", "u"} {
+		proxy := NewServer()
+		if user != "" {
+			proxy.Authentication = UserAuth(user, "p")
+		}
+		users := make(chan string, 1)
+		proxy.Resolver = NameResolverFunc(func(ctx context.Context, name string) (net.IP, error) {
+			u, ok := UserFromContext(ctx)
+			if ok != (u != "") {
+				return nil, fmt.Errorf("got %q, %v", u, ok)
+			}
+			users <- u
+			return net.IPv4(127, 0, 0, 1), nil
+		})
+
+		dial := &Dialer{
+			Username: user,
+			Password: "p",
+			ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return proxy.Pipe(), nil
+			},
+		}
+		_, port, _ := net.SplitHostPort(testServer.Listener.Addr().String())
+		conn, err := dial.Dial("tcp", net.JoinHostPort("backend.test", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if got := <-users; got != user {
+			t.Fatalf("want user %q, got %q", user, got)
+		}
+	}
+}
+
+func TestConnID(t *testing.T) {
+	proxy := NewServer()
+	dialIDs := make(chan string, 2)
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		dialIDs <- ConnID(ctx)
+		return net.Dial(network, address)
+	}
+	closeIDs := make(chan string, 2)
+	proxy.OnConnClose = func(req *Request, sent, received int64, err error) {
+		closeIDs <- req.ConnID
+	}
+	dial := &Dialer{
+		ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return proxy.Pipe(), nil
+		},
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		id := <-dialIDs
+		if id == "" || seen[id] {
+			t.Fatalf("want a new connection ID, got %q", id)
+		}
+		seen[id] = true
+		if got := <-closeIDs; got != id {
+			t.Fatalf("want connection ID %q on close, got %q", id, got)
+		}
+	}
+	if id := ConnID(context.Background()); id != "" {
+		t.Fatalf("want no connection ID, got %q", id)
+	}
+}
+
+type tenantKey struct{}
+
+func TestServerAuthenticatorWithContext(t *testing.T) {
+	proxy := NewServer()
+	proxy.Authentication = AuthenticatorWithContextFunc(func(ctx context.Context, info AuthInfo) (context.Context, bool, error) {
+		switch info.Username {
+		case "down":
+			return nil, false, errors.New("backend unavailable")
+		case "u":
+			return context.WithValue(ctx, tenantKey{}, "tenant-"+info.Password), info.Password == "p", nil
+		}
+		return nil, false, nil
+	})
+	tenants := make(chan interface{}, 1)
+	proxy.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		tenants <- ctx.Value(tenantKey{})
+		return net.Dial(network, address)
+	}
+
+	dial := func(username string) error {
+		dialer := &Dialer{
+			Username: username,
+			Password: "p",
+			ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return proxy.Pipe(), nil
+			},
+		}
+		conn, err := dialer.Dial("tcp", testServer.Listener.Addr().String())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	if err := dial("u"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-tenants; got != "tenant-p" {
+		t.Fatalf("want tenant %q, got %v", "tenant-p", got)
+	}
+	if err := dial("down"); err == nil {
+		t.Fatal("want authentication to fail")
+	}
+	if err := dial("other"); err == nil {
+		t.Fatal("want authentication to fail")
+	}
+}
+
+// fakeAddrPacketConn is a net.PacketConn with a custom local address.
+type fakeAddrPacketConn struct {
+	net.PacketConn
+	addr string
+}
+
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "fake" }
+func (a fakeAddr) String() string  { return string(a) }
+
+func (c *fakeAddrPacketConn) LocalAddr() net.Addr {
+	return fakeAddr(c.addr)
+}
+
+func TestUDPAssociateFakePacketConn(t *testing.T) {
+	tests := []struct {
+		name  string
+		addr  func(real net.Addr) string
+		reply Reply
+	}{
+		{"parsable", func(real net.Addr) string { return real.String() }, SuccessReply},
+		{"unparsable", func(real net.Addr) string { return "fake" }, ServerFailureReply},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listen, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listen.Close()
+
+			realPort := make(chan int, 1)
+			proxy := NewServer()
+			proxy.ProxyListenPacket = func(ctx context.Context, network string, address string) (net.PacketConn, error) {
+				packet, err := net.ListenPacket(network, "127.0.0.1:0")
+				if err != nil {
+					return nil, err
+				}
+				realPort <- packet.LocalAddr().(*net.UDPAddr).Port
+				return &fakeAddrPacketConn{PacketConn: packet, addr: tt.addr(packet.LocalAddr())}, nil
+			}
+			go proxy.Serve(listen)
+
+			control, err := net.Dial("tcp", listen.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer control.Close()
+			var request bytes.Buffer
+			request.Write([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(AssociateCommand), 0})
+			WriteAddr(&request, &Address{IP: net.IPv4zero.To4()})
+			_, err = control.Write(request.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var header [5]byte
+			_, err = io.ReadFull(control, header[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header[3] != byte(tt.reply) {
+				t.Fatalf("want reply %v, got %v", tt.reply, header)
+			}
+			if tt.reply != SuccessReply {
+				return
+			}
+			bound, err := ReadAddr(control)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port := <-realPort; bound.Port != port {
+				t.Fatalf("want port %d, got %v", port, bound)
+			}
+		})
+	}
+}
+
+func TestServerListenConfig(t *testing.T) {
+	var controlled int32
+	proxy := NewServer()
+	proxy.ListenConfig.Control = func(network, address string, c syscall.RawConn) error {
+		atomic.AddInt32(&controlled, 1)
+		return nil
+	}
+	listen, err := proxy.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen.Close()
+	if atomic.LoadInt32(&controlled) != 1 {
+		t.Fatal("want the listening socket controlled")
+	}
+}
+
+func TestServerHandleConn(t *testing.T) {
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- proxy.HandleConn(context.Background(), server)
+	}()
+	go client.Write([]byte{socks5Version, 1, byte(noAuth)})
+
+	var reply [2]byte
+	_, err := io.ReadFull(client, reply[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrNoSupportedAuth) {
+			t.Fatalf("want %v, got %v", ErrNoSupportedAuth, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("HandleConn did not return")
+	}
+}
+
+func TestServerAccessLog(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	entries := make(chan AccessLogEntry, 1)
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u", "p")
+	proxy.AccessLog = func(entry AccessLogEntry) {
+		entries <- entry
+	}
+
+	dial, err := NewDialer("socks5://u:p@placeholder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial.ProxyDial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return proxy.Pipe(), nil
+	}
+	conn, err := dial.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case entry := <-entries:
+		if entry.Username != "u" || entry.Command != ConnectCommand || entry.Destination.String() != target.Addr().String() {
+			t.Fatalf("unexpected entry %+v", entry)
+		}
+		if entry.BytesSent != 4 || entry.BytesReceived != 4 {
+			t.Fatalf("want 4 bytes each way, got %d and %d", entry.BytesSent, entry.BytesReceived)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no access log entry")
+	}
+}
+
+func TestServerAuthRequired(t *testing.T) {
+	tests := []struct {
+		name     string
+		required bool
+		offered  []byte
+		want     byte
+	}{
+		{"trusted", false, []byte{byte(noAuth)}, byte(noAuth)},
+		{"trusted prefers auth", false, []byte{byte(noAuth), byte(userAuth)}, byte(userAuth)},
+		{"untrusted", true, []byte{byte(noAuth)}, byte(noAcceptable)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := NewServer()
+			proxy.Authentication = UserAuth("u", "p")
+			proxy.AuthRequired = func(conn net.Conn) bool {
+				return tt.required
+			}
+			conn := proxy.Pipe()
+			defer conn.Close()
+
+			go conn.Write(append([]byte{socks5Version, byte(len(tt.offered))}, tt.offered...))
+			var reply [2]byte
+			_, err := io.ReadFull(conn, reply[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply[1] != tt.want {
+				t.Fatalf("want method %d, got %d", tt.want, reply[1])
+			}
+		})
+	}
+}
+
+func TestServerClosedBeforeNegotiation(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []byte
+		logged bool
+	}{
+		{"immediate close", nil, false},
+		{"truncated methods", []byte{socks5Version, 3, byte(noAuth)}, false},
+		{"unsupported version", []byte{socks4Version}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged int32
+			proxy := NewServer()
+			proxy.OnError = func(ctx context.Context, phase string, conn net.Conn, err error) {
+				atomic.AddInt32(&logged, 1)
+			}
+			client, server := net.Pipe()
+			go func() {
+				client.Write(tt.input)
+				client.Close()
+			}()
+			proxy.HandleConn(context.Background(), server)
+			if got := atomic.LoadInt32(&logged) != 0; got != tt.logged {
+				t.Fatalf("want logged %v, got %v", tt.logged, got)
+			}
+		})
+	}
+}
+
+func TestReadAddrIPv4Mapped(t *testing.T) {
+	mapped := net.ParseIP("::ffff:192.0.2.1")
+	var buf bytes.Buffer
+	buf.WriteByte(ipv6Address)
+	buf.Write(mapped.To16())
+	buf.Write([]byte{0, 80})
+	addr, err := ReadAddr(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addr.IP) != net.IPv4len || !addr.IP.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("want the IPv4 address, got %#v", addr.IP)
+	}
+	if got := (&Address{IP: mapped, Port: 80}).Address(); got != "192.0.2.1:80" {
+		t.Fatalf("want 192.0.2.1:80, got %s", got)
+	}
+
+	var reply bytes.Buffer
+	err = WriteAddr(&reply, &Address{IP: mapped, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{ipv4Address, 192, 0, 2, 1, 0, 80}; !bytes.Equal(reply.Bytes(), want) {
+		t.Fatalf("want %v, got %v", want, reply.Bytes())
+	}
+}
+
+func TestServerOnUDPDatagram(t *testing.T) {
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packet.Close()
+	go func() {
+		var buf [maxUdpPacket]byte
+		for {
+			n, addr, err := packet.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			packet.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.OnUDPDatagram = func(ctx context.Context, src net.Addr, dst *Address, payload []byte) bool {
+		return !bytes.Equal(payload, []byte("blocked"))
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks5://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("udp", packet.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, msg := range []string{"blocked", "allowed"} {
+		_, err = conn.Write([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, 1024)
+	n, err := conn.Read(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got[:n]) != "allowed" {
+		t.Fatalf("want allowed, got %q", got[:n])
+	}
+}
+
+func TestUDPAssociateMultipleDestinations(t *testing.T) {
+	var echoes []net.PacketConn
+	for i := 0; i < 2; i++ {
+		packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer packet.Close()
+		go func() {
+			var buf [maxUdpPacket]byte
+			n, addr, err := packet.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			packet.WriteTo(buf[:n], addr)
+		}()
+		echoes = append(echoes, packet)
+	}
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	proxy := NewServer()
+	go proxy.Serve(listen)
+
+	control, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	var request bytes.Buffer
+	request.Write([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(AssociateCommand), 0})
+	WriteAddr(&request, &Address{IP: net.IPv4zero.To4()})
+	_, err = control.Write(request.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header [5]byte
+	_, err = io.ReadFull(control, header[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound, err := ReadAddr(control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.Dial("udp", bound.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+
+	// Each datagram carries its own destination in its header,
+	// and each reply the address of the destination it comes from.
+	for i, echo := range echoes {
+		dst := echo.LocalAddr().(*net.UDPAddr)
+		var datagram bytes.Buffer
+		datagram.Write([]byte{0, 0, 0})
+		WriteAddr(&datagram, &Address{IP: dst.IP, Port: dst.Port})
+		fmt.Fprintf(&datagram, "ping %d", i)
+		_, err = relay.Write(datagram.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		relay.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 1024)
+		n, err := relay.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < 3 || buf[0] != 0 || buf[1] != 0 || buf[2] != 0 {
+			t.Fatalf("want RSV and FRAG zero, got %v", buf[:n])
+		}
+		reply := bytes.NewReader(buf[3:n])
+		src, err := ReadAddr(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src.String() != dst.String() {
+			t.Fatalf("want reply from %v, got %v", dst, src)
+		}
+		payload, _ := ioutil.ReadAll(reply)
+		if want := fmt.Sprintf("ping %d", i); string(payload) != want {
+			t.Fatalf("want %q, got %q", want, payload)
+		}
+	}
+}
+
+type testHandshakeMetrics struct {
+	testMetrics
+	handshakes chan testHandshake
+}
+
+type testHandshake struct {
+	d    time.Duration
+	auth bool
+}
+
+func (m *testHandshakeMetrics) ObserveHandshakeDuration(d time.Duration, auth bool) {
+	m.handshakes <- testHandshake{d, auth}
+}
+
+func TestServerHandshakeMetrics(t *testing.T) {
+	for _, auth := range []bool{false, true} {
+		metrics := &testHandshakeMetrics{handshakes: make(chan testHandshake, 1)}
+		proxy := NewServer()
+		proxy.Metrics = metrics
+		// The handshake lasts until the reply, past a slow Rewrite.
+		const delay = 50 * time.Millisecond
+		proxy.Rewrite = func(ctx context.Context, req *Request) (*Address, error) {
+			time.Sleep(delay)
+			return nil, nil
+		}
+		dial := &Dialer{
+			ProxyDial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return proxy.Pipe(), nil
+			},
+		}
+		if auth {
+			proxy.Authentication = UserAuth("u", "p")
+			dial.Username, dial.Password = "u", "p"
+		}
+		conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		got := <-metrics.handshakes
+		if got.auth != auth {
+			t.Fatalf("want auth %v, got %v", auth, got.auth)
+		}
+		if got.d < delay {
+			t.Fatalf("want a handshake of at least %v, got %v", delay, got.d)
+		}
+	}
+}
@@ -1,5 +1,21 @@
 package socks5
 
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// authFailureTimeout is the time allowed to write an authentication
+// failure after the client timed out during sub-negotiation.
+const authFailureTimeout = time.Second
+
 // AuthenticationFunc Authentication interface is implemented
 type AuthenticationFunc func(cmd Command, username, password string) bool
 
@@ -13,9 +29,239 @@ type Authentication interface {
 	Auth(cmd Command, username, password string) bool
 }
 
+// AuthInfo is a username/password authentication attempt
+type AuthInfo struct {
+	Username   string
+	Password   string
+	RemoteAddr net.Addr
+}
+
+// AuthenticatorContextFunc AuthenticatorContext interface is implemented
+type AuthenticatorContextFunc func(ctx context.Context, info AuthInfo) bool
+
+// Auth authentication processing without a client address
+func (f AuthenticatorContextFunc) Auth(cmd Command, username, password string) bool {
+	return f(context.Background(), AuthInfo{Username: username, Password: password})
+}
+
+// AuthContext authentication processing
+func (f AuthenticatorContextFunc) AuthContext(ctx context.Context, info AuthInfo) bool {
+	return f(ctx, info)
+}
+
+// AuthenticatorContext is optionally implemented by an Authentication
+// to receive the context and client address of an attempt.
+// To migrate an Authentication, add an AuthContext method,
+// or wrap a function in AuthenticatorContextFunc;
+// Auth is then no longer called by the Server
+type AuthenticatorContext interface {
+	Authentication
+	AuthContext(ctx context.Context, info AuthInfo) bool
+}
+
+// AuthenticatorWithContextFunc AuthenticatorWithContext interface is implemented
+type AuthenticatorWithContextFunc func(ctx context.Context, info AuthInfo) (context.Context, bool, error)
+
+// Auth authentication processing without a client address
+func (f AuthenticatorWithContextFunc) Auth(cmd Command, username, password string) bool {
+	_, ok, err := f(context.Background(), AuthInfo{Username: username, Password: password})
+	return ok && err == nil
+}
+
+// AuthWithContext authentication processing
+func (f AuthenticatorWithContextFunc) AuthWithContext(ctx context.Context, info AuthInfo) (context.Context, bool, error) {
+	return f(ctx, info)
+}
+
+// AuthenticatorWithContext is optionally implemented by an Authentication
+// to return the context used for the rest of the connection,
+// such as one carrying the user's tenant or routing hints.
+// A nil context keeps the current one, and an error fails the
+// authentication without counting as wrong credentials.
+// It takes precedence over AuthenticatorContext
+type AuthenticatorWithContext interface {
+	Authentication
+	AuthWithContext(ctx context.Context, info AuthInfo) (context.Context, bool, error)
+}
+
 // UserAuth basic authentication
 func UserAuth(username, password string) Authentication {
 	return AuthenticationFunc(func(c Command, u, p string) bool {
 		return username == u && password == p
 	})
 }
+
+// StaticCredentials is an Authentication with a fixed set of
+// passwords by username, compared in constant time
+type StaticCredentials map[string]string
+
+// Auth authentication processing
+func (c StaticCredentials) Auth(cmd Command, username, password string) bool {
+	want, ok := c[username]
+	if !ok {
+		// Compare anyway so that unknown usernames take as long.
+		want = password + "\x00"
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1 && ok
+}
+
+// LoadCredentials reads StaticCredentials from a file
+// with one user:password per line
+func LoadCredentials(name string) (StaticCredentials, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadCredentials(f)
+}
+
+// ReadCredentials reads StaticCredentials with one user:password per line,
+// empty lines and lines starting with # are skipped
+func ReadCredentials(r io.Reader) (StaticCredentials, error) {
+	creds := StaticCredentials{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.IndexByte(text, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid credentials at line %d", line)
+		}
+		creds[text[:i]] = text[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// AuthMethod is a SOCKS authentication method
+type AuthMethod interface {
+	// Method returns the method code used during method selection
+	Method() byte
+	// Authenticate performs the method-specific sub-negotiation on conn,
+	// returns the connection to use for the rest of the session
+	// and the authenticated username if any
+	Authenticate(conn net.Conn) (net.Conn, string, error)
+}
+
+// contextAuthMethod is implemented by the AuthMethods that
+// pass the connection's context to their Authentication.
+type contextAuthMethod interface {
+	authenticateContext(ctx context.Context, conn net.Conn) (context.Context, net.Conn, string, error)
+}
+
+// AuthMethodFilter is optionally implemented by an AuthMethod
+// to be selected only for some connections
+type AuthMethodFilter interface {
+	// Accept reports whether the method may be selected for conn
+	Accept(conn net.Conn) bool
+}
+
+// NoAuthMethod returns an AuthMethod that requires no authentication
+func NoAuthMethod() AuthMethod {
+	return noAuthMethod{}
+}
+
+type noAuthMethod struct{}
+
+func (noAuthMethod) Method() byte {
+	return byte(noAuth)
+}
+
+func (noAuthMethod) Authenticate(conn net.Conn) (net.Conn, string, error) {
+	return conn, "", nil
+}
+
+// UserAuthMethod returns an AuthMethod using username/password authentication
+func UserAuthMethod(auth Authentication) AuthMethod {
+	return userAuthMethod{auth: auth}
+}
+
+type userAuthMethod struct {
+	auth Authentication
+}
+
+func (m userAuthMethod) Method() byte {
+	return byte(userAuth)
+}
+
+func (m userAuthMethod) Authenticate(conn net.Conn) (net.Conn, string, error) {
+	_, conn, username, err := m.authenticateContext(context.Background(), conn)
+	return conn, username, err
+}
+
+func (m userAuthMethod) authenticateContext(ctx context.Context, conn net.Conn) (context.Context, net.Conn, string, error) {
+	ctx, username, err := m.authenticate(ctx, conn)
+	if err != nil {
+		if isTimeoutError(err) {
+			conn.SetWriteDeadline(time.Now().Add(authFailureTimeout))
+			conn.Write([]byte{userAuthVersion, authFailure})
+		}
+		return nil, nil, "", err
+	}
+	return ctx, conn, username, nil
+}
+
+func (m userAuthMethod) authenticate(ctx context.Context, conn net.Conn) (context.Context, string, error) {
+	header, err := readByte(conn)
+	if err != nil {
+		return nil, "", err
+	}
+	if header != userAuthVersion {
+		return nil, "", fmt.Errorf("%w: auth version %d", ErrUnsupportedVersion, header)
+	}
+
+	// RFC 1929 fields are 1 to 255 bytes long, but some clients
+	// send an empty password, which is tolerated.
+	username, err := readBytes(conn)
+	if err != nil {
+		return nil, "", fmt.Errorf("read username: %w", err)
+	}
+	if len(username) == 0 {
+		return nil, "", errEmptyUsername
+	}
+
+	password, err := readBytes(conn)
+	if err != nil {
+		return nil, "", fmt.Errorf("read password: %w", err)
+	}
+
+	info := AuthInfo{
+		Username:   string(username),
+		Password:   string(password),
+		RemoteAddr: conn.RemoteAddr(),
+	}
+	var ok bool
+	switch auth := m.auth.(type) {
+	case AuthenticatorWithContext:
+		var authCtx context.Context
+		authCtx, ok, err = auth.AuthWithContext(ctx, info)
+		if err != nil {
+			conn.Write([]byte{userAuthVersion, authFailure})
+			return nil, "", err
+		}
+		if authCtx != nil {
+			ctx = authCtx
+		}
+	case AuthenticatorContext:
+		ok = auth.AuthContext(ctx, info)
+	default:
+		ok = m.auth.Auth(0, info.Username, info.Password)
+	}
+	if !ok {
+		_, err := conn.Write([]byte{userAuthVersion, authFailure})
+		if err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrUserAuthFailed
+	}
+	_, err = conn.Write([]byte{userAuthVersion, authSuccess})
+	if err != nil {
+		return nil, "", err
+	}
+	return ctx, info.Username, nil
+}
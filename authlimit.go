@@ -0,0 +1,101 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AuthLimiter limits authentication attempts, per client for example
+type AuthLimiter interface {
+	// Allow reports whether a client may attempt to authenticate
+	Allow(addr net.Addr) bool
+	// Failure records a failed authentication of a client
+	Failure(addr net.Addr)
+	// Success records a successful authentication of a client
+	Success(addr net.Addr)
+}
+
+// NewAuthLimiter returns an in-memory AuthLimiter that blocks a client IP
+// once it failed to authenticate threshold times within window,
+// until window has passed since its first failure
+func NewAuthLimiter(threshold int, window time.Duration) AuthLimiter {
+	return &authLimiter{
+		threshold: threshold,
+		window:    window,
+		failures:  map[string]*authFailures{},
+	}
+}
+
+type authFailures struct {
+	count int
+	first time.Time
+}
+
+type authLimiter struct {
+	threshold int
+	window    time.Duration
+
+	mu        sync.Mutex
+	failures  map[string]*authFailures
+	lastPrune time.Time
+}
+
+func (l *authLimiter) Allow(addr net.Addr) bool {
+	key := ipKey(addr)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.failures[key]
+	if !ok {
+		return true
+	}
+	if now.Sub(f.first) > l.window {
+		delete(l.failures, key)
+		return true
+	}
+	return f.count < l.threshold
+}
+
+func (l *authLimiter) Failure(addr net.Addr) {
+	key := ipKey(addr)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPrune) > l.window {
+		for k, f := range l.failures {
+			if now.Sub(f.first) > l.window {
+				delete(l.failures, k)
+			}
+		}
+		l.lastPrune = now
+	}
+	f, ok := l.failures[key]
+	if !ok || now.Sub(f.first) > l.window {
+		f = &authFailures{first: now}
+		l.failures[key] = f
+	}
+	f.count++
+}
+
+func (l *authLimiter) Success(addr net.Addr) {
+	key := ipKey(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+}
+
+// ipKey returns the IP of addr, or addr itself if it has no IP.
+func ipKey(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -86,6 +86,17 @@ func (d *Dialer) Dial(network, address string) (net.Conn, error) {
 	return d.DialContext(context.Background(), network, address)
 }
 
+// ChainDial returns a function suitable for Server.ProxyDial that dials
+// through the upstream proxy, so that the Server becomes a relay.
+// Reply codes of the upstream proxy are passed back to the client.
+// Domain names are resolved by the upstream only if it was created
+// with the socks5h scheme, see also Server.PassThroughNames.
+// Only CONNECT is relayed, BIND and ASSOCIATE are still served
+// by the Server itself
+func ChainDial(upstream *Dialer) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return upstream.DialContext
+}
+
 func (d *Dialer) Listen(ctx context.Context, network, address string) (net.Listener, error) {
 	switch network {
 	default:
@@ -122,7 +133,12 @@ func (d *Dialer) do(ctx context.Context, cmd Command, address string) (net.Conn,
 		return nil, err
 	}
 
-	return d.connect(ctx, conn, cmd, address)
+	c, err := d.connect(ctx, conn, cmd, address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
 func (d *Dialer) connect(ctx context.Context, conn net.Conn, cmd Command, address string) (net.Conn, error) {
@@ -190,6 +206,7 @@ func (d *Dialer) connect(ctx context.Context, conn net.Conn, cmd Command, addres
 		}
 		wrapConn, err := NewUDPConn(udpConn, proxyAddr, targetAddr)
 		if err != nil {
+			udpConn.Close()
 			return nil, err
 		}
 
@@ -299,11 +316,11 @@ func (d *Dialer) readReply(conn net.Conn) (net.Addr, error) {
 		return nil, fmt.Errorf("unexpected protocol version %d", header[0])
 	}
 
-	if reply(header[1]) != successReply {
-		return nil, fmt.Errorf("unknown error %s", reply(header[1]).String())
+	if Reply(header[1]) != SuccessReply {
+		return nil, &ReplyError{code: Reply(header[1])}
 	}
 
-	return readAddr(conn)
+	return ReadAddr(conn)
 }
 
 func (d *Dialer) resolver() *net.Resolver {
@@ -331,6 +348,27 @@ func (d *Dialer) proxyPacketDial(ctx context.Context, network, address string) (
 	return proxyPacketDial(ctx, network, address)
 }
 
+// ReplyError is returned by the Dialer when the proxy server replies
+// with a non-success reply code.
+type ReplyError struct {
+	code Reply
+}
+
+// NewReplyError returns a ReplyError with code, hooks such as
+// Server.Rewrite may return it to choose the reply code sent
+func NewReplyError(code Reply) *ReplyError {
+	return &ReplyError{code: code}
+}
+
+// Code returns the reply code sent by the proxy server.
+func (e *ReplyError) Code() Reply {
+	return e.code
+}
+
+func (e *ReplyError) Error() string {
+	return "socks5: " + e.code.String()
+}
+
 type listener struct {
 	ctx     context.Context
 	d       *Dialer
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"net"
@@ -12,17 +13,64 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var (
-	errStringTooLong        = errors.New("string too long")
-	errUserAuthFailed       = errors.New("user authentication failed")
-	errNoSupportedAuth      = errors.New("no supported authentication mechanism")
-	errUnrecognizedAddrType = errors.New("unrecognized address type")
+	errStringTooLong    = errors.New("string too long")
+	errEmptyBuffer      = errors.New("empty buffer from BytesPool")
+	errEmptyUsername    = errors.New("empty username")
+	errEmptyName        = errors.New("empty domain name")
+	errNoFreePort       = errors.New("no free port in range")
+	errInvalidPortRange = errors.New("invalid port range")
+	// errClosedEarly is a benign close of a client, such as a port
+	// scanner, before method negotiation, which is not logged.
+	errClosedEarly = errors.New("client closed before method negotiation")
+)
+
+var (
+	// ErrUnsupportedVersion is returned when a client uses
+	// an unsupported protocol or sub-negotiation version
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	// ErrUnsupportedCommand is returned when a client requests
+	// an unsupported command
+	ErrUnsupportedCommand = errors.New("unsupported command")
+	// ErrUserAuthFailed is returned when a client fails to authenticate
+	ErrUserAuthFailed = errors.New("user authentication failed")
+	// ErrNoSupportedAuth is returned when a client offers
+	// no acceptable authentication method
+	ErrNoSupportedAuth = errors.New("no supported authentication mechanism")
+	// ErrUnrecognizedAddrType is returned when a client uses
+	// an unrecognized address type
+	ErrUnrecognizedAddrType = errors.New("unrecognized address type")
+	// ErrAuthLimited is returned when a client is blocked
+	// by the AuthLimiter after too many failed authentications
+	ErrAuthLimited = errors.New("too many failed authentications")
+	// ErrRequestLimited is returned when a connection is
+	// closed by the RequestLimiter
+	ErrRequestLimited = errors.New("too many requests")
+	// ErrQuotaExceeded is returned when a request is denied, or a
+	// tunnel or association closed, because its user is over Quota
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrNotAllowed is returned when a request is denied by the RuleSet
+	ErrNotAllowed = errors.New("not allowed by ruleset")
+	// ErrInvalidDestination is returned when a CONNECT request
+	// has a destination with port 0 or an unspecified IP
+	ErrInvalidDestination = errors.New("invalid destination")
+	// ErrProtocolViolation is returned when a client sends a non-zero
+	// reserved field while StrictProtocol is set
+	ErrProtocolViolation = errors.New("protocol violation")
 )
 
 const (
 	maxUdpPacket = math.MaxUint16 - 28
+	// maxUDPHeaderLen is the length of a UDP request header
+	// with the longest domain name.
+	maxUDPHeaderLen   = 3 + 1 + 1 + 255 + 2
+	defaultBufferSize = 32 * 1024
 )
 
 const (
@@ -51,54 +99,88 @@ func (cmd Command) String() string {
 	}
 }
 
+// ParseCommand returns the Command named by s, such as "connect",
+// "BIND" or "socks associate", as in configuration files
+func ParseCommand(s string) (Command, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	name = strings.TrimPrefix(name, "socks ")
+	for _, cmd := range []Command{ConnectCommand, BindCommand, AssociateCommand} {
+		if "socks "+name == cmd.String() {
+			return cmd, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnsupportedCommand, s)
+}
+
 const (
-	successReply         reply = 0x00
-	serverFailure        reply = 0x01
-	ruleFailure          reply = 0x02
-	networkUnreachable   reply = 0x03
-	hostUnreachable      reply = 0x04
-	connectionRefused    reply = 0x05
-	ttlExpired           reply = 0x06
-	commandNotSupported  reply = 0x07
-	addrTypeNotSupported reply = 0x08
+	SuccessReply              Reply = 0x00
+	ServerFailureReply        Reply = 0x01
+	RuleFailureReply          Reply = 0x02
+	NetworkUnreachableReply   Reply = 0x03
+	HostUnreachableReply      Reply = 0x04
+	ConnectionRefusedReply    Reply = 0x05
+	TTLExpiredReply           Reply = 0x06
+	CommandNotSupportedReply  Reply = 0x07
+	AddrTypeNotSupportedReply Reply = 0x08
 )
 
-func errToReply(err error) reply {
+func errToReply(err error) Reply {
 	if err == nil {
-		return successReply
+		return SuccessReply
+	}
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.code
+	}
+	switch {
+	case errors.Is(err, ErrNotAllowed):
+		return RuleFailureReply
+	case errors.Is(err, errNoFreePort), errors.Is(err, errInvalidPortRange):
+		return ServerFailureReply
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectionRefusedReply
+	case errors.Is(err, syscall.ENETUNREACH):
+		return NetworkUnreachableReply
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return HostUnreachableReply
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return HostUnreachableReply
 	}
 	msg := err.Error()
-	resp := hostUnreachable
+	resp := HostUnreachableReply
 	if strings.Contains(msg, "refused") {
-		resp = connectionRefused
+		resp = ConnectionRefusedReply
 	} else if strings.Contains(msg, "network is unreachable") {
-		resp = networkUnreachable
+		resp = NetworkUnreachableReply
 	}
 	return resp
 }
 
-// reply is a SOCKS Command reply code.
-type reply byte
+// Reply is a SOCKS Command reply code, codes above
+// AddrTypeNotSupportedReply are unassigned or private
+type Reply byte
 
-func (code reply) String() string {
+func (code Reply) String() string {
 	switch code {
-	case successReply:
+	case SuccessReply:
 		return "succeeded"
-	case serverFailure:
+	case ServerFailureReply:
 		return "general SOCKS server failure"
-	case ruleFailure:
+	case RuleFailureReply:
 		return "connection not allowed by ruleset"
-	case networkUnreachable:
+	case NetworkUnreachableReply:
 		return "network unreachable"
-	case hostUnreachable:
+	case HostUnreachableReply:
 		return "host unreachable"
-	case connectionRefused:
+	case ConnectionRefusedReply:
 		return "connection refused"
-	case ttlExpired:
+	case TTLExpiredReply:
 		return "TTL expired"
-	case commandNotSupported:
+	case CommandNotSupportedReply:
 		return "Command not supported"
-	case addrTypeNotSupported:
+	case AddrTypeNotSupportedReply:
 		return "address type not supported"
 	default:
 		return "unknown code: " + strconv.Itoa(int(code))
@@ -111,17 +193,17 @@ const (
 	ipv6Address = 0x04
 )
 
-// address is a SOCKS-specific address.
+// Address is a SOCKS-specific address.
 // Either Name or IP is used exclusively.
-type address struct {
+type Address struct {
 	Name string // fully-qualified domain name
 	IP   net.IP
 	Port int
 }
 
-func (a *address) Network() string { return "socks5" }
+func (a *Address) Network() string { return "socks5" }
 
-func (a *address) String() string {
+func (a *Address) String() string {
 	if a == nil {
 		return "<nil>"
 	}
@@ -130,7 +212,7 @@ func (a *address) String() string {
 
 // Address returns a string suitable to dial; prefer returning IP-based
 // address, fallback to Name
-func (a address) Address() string {
+func (a Address) Address() string {
 	port := strconv.Itoa(a.Port)
 	if 0 != len(a.IP) {
 		return net.JoinHostPort(a.IP.String(), port)
@@ -148,15 +230,32 @@ const (
 	noAcceptable authMethod = 0xff // no acceptable authentication methods
 )
 
+func (m authMethod) String() string {
+	switch m {
+	case noAuth:
+		return "no authentication required"
+	case gssapiAuth:
+		return "GSSAPI"
+	case userAuth:
+		return "username/password"
+	case noAcceptable:
+		return "no acceptable methods"
+	default:
+		return "unknown method: " + strconv.Itoa(int(m))
+	}
+}
+
 const (
 	userAuthVersion = 0x01
 	authSuccess     = 0x00
 	authFailure     = 0x01
 )
 
+// readBytes reads a field prefixed by its one byte length, failing
+// with io.ErrUnexpectedEOF if it is truncated.
 func readBytes(r io.Reader) ([]byte, error) {
 	var buf [1]byte
-	_, err := r.Read(buf[:])
+	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
 		return nil, err
 	}
@@ -179,18 +278,20 @@ func writeBytes(w io.Writer, b []byte) error {
 
 func readByte(r io.Reader) (byte, error) {
 	var buf [1]byte
-	_, err := r.Read(buf[:])
+	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
 		return 0, err
 	}
 	return buf[0], nil
 }
 
-func readAddr(r io.Reader) (*address, error) {
-	address := &address{}
+// ReadAddr reads a SOCKS5 address, as in requests, replies
+// and UDP headers, from r
+func ReadAddr(r io.Reader) (*Address, error) {
+	address := &Address{}
 
 	var addrType [1]byte
-	if _, err := r.Read(addrType[:]); err != nil {
+	if _, err := io.ReadFull(r, addrType[:]); err != nil {
 		return nil, err
 	}
 
@@ -206,19 +307,27 @@ func readAddr(r io.Reader) (*address, error) {
 		if _, err := io.ReadFull(r, addr); err != nil {
 			return nil, err
 		}
+		// Treat IPv4-mapped addresses as the IPv4 addresses they are,
+		// as they are dialed and written in replies.
+		if ip4 := addr.To4(); ip4 != nil {
+			addr = ip4
+		}
 		address.IP = addr
 	case fqdnAddress:
-		if _, err := r.Read(addrType[:]); err != nil {
+		if _, err := io.ReadFull(r, addrType[:]); err != nil {
 			return nil, err
 		}
 		addrLen := int(addrType[0])
+		if addrLen == 0 {
+			return nil, errEmptyName
+		}
 		fqdn := make([]byte, addrLen)
 		if _, err := io.ReadFull(r, fqdn); err != nil {
 			return nil, err
 		}
 		address.Name = string(fqdn)
 	default:
-		return nil, errUnrecognizedAddrType
+		return nil, ErrUnrecognizedAddrType
 	}
 	var port [2]byte
 	if _, err := io.ReadFull(r, port[:]); err != nil {
@@ -228,7 +337,9 @@ func readAddr(r io.Reader) (*address, error) {
 	return address, nil
 }
 
-func writeAddr(w io.Writer, addr *address) error {
+// WriteAddr writes addr in the SOCKS5 wire format to w,
+// a nil addr is written as the IPv4 address 0.0.0.0:0
+func WriteAddr(w io.Writer, addr *Address) error {
 	if addr == nil {
 		_, err := w.Write([]byte{ipv4Address, 0, 0, 0, 0, 0, 0})
 		if err != nil {
@@ -291,9 +402,9 @@ func writeAddrWithStr(w io.Writer, addr string) error {
 		return err
 	}
 	if ip := net.ParseIP(host); ip != nil {
-		return writeAddr(w, &address{IP: ip, Port: port})
+		return WriteAddr(w, &Address{IP: ip, Port: port})
 	}
-	return writeAddr(w, &address{Name: host, Port: port})
+	return WriteAddr(w, &Address{Name: host, Port: port})
 }
 
 func splitHostPort(address string) (string, int, error) {
@@ -311,12 +422,24 @@ func splitHostPort(address string) (string, int, error) {
 	return host, portnum, nil
 }
 
+// closedBeforeNegotiation marks an end of file read before method
+// negotiation as errClosedEarly.
+func closedBeforeNegotiation(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", errClosedEarly, err)
+	}
+	return err
+}
+
 // isClosedConnError reports whether err is an error from use of a closed
 // network connection.
 func isClosedConnError(err error) bool {
 	if err == nil {
 		return false
 	}
+	if errors.Is(err, errClosedEarly) {
+		return true
+	}
 
 	str := err.Error()
 	if strings.Contains(str, "use of closed network connection") {
@@ -337,6 +460,25 @@ func isClosedConnError(err error) bool {
 	return false
 }
 
+// isTimeoutError reports whether err is a timeout error.
+func isTimeoutError(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// isTransientError reports whether err is a timeout or temporary error
+// that may not happen again.
+func isTransientError(err error) bool {
+	if errors.Is(err, ErrNotAllowed) {
+		return false
+	}
+	if isTimeoutError(err) {
+		return true
+	}
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
 func errno(v error) uintptr {
 	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Uintptr {
 		return uintptr(rv.Uint())
@@ -344,26 +486,241 @@ func errno(v error) uintptr {
 	return 0
 }
 
-// tunnel create tunnels for two io.ReadWriteCloser
-func tunnel(ctx context.Context, c1, c2 io.ReadWriteCloser, buf1, buf2 []byte) error {
+// tunnel create tunnels for two io.ReadWriteCloser,
+// and returns the number of bytes written to c1 and c2.
+// When one direction reaches EOF, the write side of its destination
+// is closed if supported and the other direction keeps flowing
+func tunnel(ctx context.Context, c1, c2 io.ReadWriteCloser, buf1, buf2 []byte) (int64, int64, error) {
+	return drainTunnel(ctx, c1, c2, buf1, buf2, 0)
+}
+
+// drainTunnel is tunnel, but once ctx is done it stops reading and waits
+// up to drainTimeout for the bytes already read to be written before
+// closing the connections.
+func drainTunnel(ctx context.Context, c1, c2 io.ReadWriteCloser, buf1, buf2 []byte, drainTimeout time.Duration) (int64, int64, error) {
 	ctx, cancel := context.WithCancel(ctx)
-	var errs tunnelErr
+	var (
+		errs   tunnelErr
+		n1, n2 int64
+		wg     sync.WaitGroup
+	)
+	wg.Add(2)
 	go func() {
-		_, errs[0] = io.CopyBuffer(c1, c2, buf1)
-		cancel()
+		defer wg.Done()
+		n1, errs[0] = io.CopyBuffer(c1, c2, buf1)
+		if errs[0] != nil || !closeWrite(c1) {
+			cancel()
+		}
 	}()
 	go func() {
-		_, errs[1] = io.CopyBuffer(c2, c1, buf2)
+		defer wg.Done()
+		n2, errs[1] = io.CopyBuffer(c2, c1, buf2)
+		if errs[1] != nil || !closeWrite(c2) {
+			cancel()
+		}
+	}()
+	copied := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(copied)
 		cancel()
 	}()
 	<-ctx.Done()
+	// Unblock the copies even if closing a wrapping
+	// connection does not interrupt a pending Read.
+	setReadDeadline(c1, aLongTimeAgo)
+	setReadDeadline(c2, aLongTimeAgo)
+	if drainTimeout > 0 {
+		timer := time.NewTimer(drainTimeout)
+		select {
+		case <-copied:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
 	errs[2] = c1.Close()
 	errs[3] = c2.Close()
+	wg.Wait()
 	errs[4] = ctx.Err()
 	if errs[4] == context.Canceled {
 		errs[4] = nil
 	}
-	return errs.FirstError()
+	return n1, n2, errs.FirstError()
+}
+
+// setReadDeadline sets the read deadline of c if it has one.
+func setReadDeadline(c interface{}, t time.Time) {
+	if conn, ok := c.(interface{ SetReadDeadline(time.Time) error }); ok {
+		conn.SetReadDeadline(t)
+	}
+}
+
+// closeWrite shuts down the writing side of c, looking through
+// wrapping connections, and reports whether it succeeded.
+func closeWrite(c interface{}) bool {
+	for {
+		switch conn := c.(type) {
+		case interface{ CloseWrite() error }:
+			return conn.CloseWrite() == nil
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return false
+		}
+	}
+}
+
+// setKeepAlive enables TCP keep-alives with period on c,
+// looking through wrapping connections, and reports whether it is a TCP one.
+func setKeepAlive(c interface{}, period time.Duration) bool {
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			conn.SetKeepAlive(true)
+			conn.SetKeepAlivePeriod(period)
+			return true
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return false
+		}
+	}
+}
+
+// setNoDelay sets whether Nagle's algorithm is disabled on c,
+// looking through wrapping connections, and reports whether it is a TCP one.
+func setNoDelay(c interface{}, noDelay bool) bool {
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			conn.SetNoDelay(noDelay)
+			return true
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return false
+		}
+	}
+}
+
+// aLongTimeAgo is a non-zero time, far in the past, used for
+// immediate cancellation of network operations.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchConn calls cancel if conn fails before the returned stop
+// function is called. stop returns conn, with any data read by the
+// watcher in the meantime put back in front of it.
+func watchConn(conn net.Conn, cancel context.CancelFunc) (stop func() net.Conn) {
+	var (
+		buf  [1]byte
+		n    int
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		var err error
+		n, err = conn.Read(buf[:])
+		if err != nil && !isTimeoutError(err) {
+			cancel()
+		}
+	}()
+	return func() net.Conn {
+		conn.SetReadDeadline(aLongTimeAgo)
+		<-done
+		conn.SetReadDeadline(time.Time{})
+		if n == 0 {
+			return conn
+		}
+		return &prefixConn{Conn: conn, prefix: buf[:n]}
+	}
+}
+
+// prefixConn is a net.Conn that returns prefix before reading from Conn.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+// NetConn returns the underlying connection.
+func (c *prefixConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Read implements the net.Conn Read method.
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) != 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// countingConn is a net.Conn counting the bytes read and written.
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+// NetConn returns the underlying connection.
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Read implements the net.Conn Read method.
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+// Write implements the net.Conn Write method.
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// withIdleTimeout wraps c1 and c2 so that a successful read from either
+// of them extends the read deadline of both by timeout.
+func withIdleTimeout(c1, c2 net.Conn, timeout time.Duration) (net.Conn, net.Conn) {
+	idle := &idleTimeout{
+		timeout: timeout,
+		conns:   [2]net.Conn{c1, c2},
+	}
+	idle.extend()
+	return &idleTimeoutConn{Conn: c1, idle: idle}, &idleTimeoutConn{Conn: c2, idle: idle}
+}
+
+type idleTimeout struct {
+	timeout time.Duration
+	conns   [2]net.Conn
+}
+
+func (t *idleTimeout) extend() {
+	deadline := time.Now().Add(t.timeout)
+	for _, c := range t.conns {
+		c.SetReadDeadline(deadline)
+	}
+}
+
+type idleTimeoutConn struct {
+	net.Conn
+	idle *idleTimeout
+}
+
+// NetConn returns the underlying connection.
+func (c *idleTimeoutConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.idle.extend()
+	}
+	return n, err
 }
 
 type tunnelErr [5]error
@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import (
+	"syscall"
+)
+
+// MarkControl returns a Server.Control function setting SO_MARK
+// on outbound sockets, for fwmark-based policy routing.
+// It requires the CAP_NET_ADMIN capability
+func MarkControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
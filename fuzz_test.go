@@ -0,0 +1,107 @@
+//go:build go1.18
+// +build go1.18
+
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+)
+
+// fuzzConn is a net.Conn reading from a fixed input and discarding writes.
+type fuzzConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (c *fuzzConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *fuzzConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *fuzzConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+}
+
+func FuzzUserAuth(f *testing.F) {
+	f.Add([]byte{userAuthVersion, 1, 'u', 1, 'p'})
+	f.Add([]byte{userAuthVersion, 1, 'u', 0})
+	f.Add([]byte{userAuthVersion, 0, 1, 'p'})
+	f.Add([]byte{userAuthVersion, 5, 'u'})
+	f.Add([]byte{userAuthVersion, 1, 'u', 255})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := userAuthMethod{auth: AuthenticationFunc(func(cmd Command, username, password string) bool {
+			return true
+		})}
+		_, username, err := m.authenticate(context.Background(), &fuzzConn{r: bytes.NewReader(data)})
+		if err == nil && (len(username) == 0 || len(username) > 255) {
+			t.Fatalf("accepted username of %d bytes", len(username))
+		}
+	})
+}
+
+func FuzzReadAddr(f *testing.F) {
+	f.Add([]byte{ipv4Address, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{ipv6Address, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80})
+	f.Add([]byte{ipv6Address, 0, 0, 0, 0})
+	f.Add([]byte{fqdnAddress, 0, 0, 80})
+	f.Add([]byte{fqdnAddress, 4, 'h', 'o', 's', 't', 0, 80})
+	f.Add([]byte{fqdnAddress, 10, 'h'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		addr, err := ReadAddr(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if addr.Name == "" && addr.IP == nil {
+			t.Fatalf("read an address without name nor IP from %x", data)
+		}
+		var buf bytes.Buffer
+		err = WriteAddr(&buf, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadAddr(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != addr.String() {
+			t.Fatalf("want %v, got %v", addr, got)
+		}
+	})
+}
+
+func FuzzHandshake(f *testing.F) {
+	f.Add([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(ConnectCommand), 0, ipv4Address, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{socks5Version, 1, byte(userAuth), userAuthVersion, 1, 'u', 1, 'p', socks5Version, byte(ConnectCommand), 0, fqdnAddress, 1, 'h', 0, 80})
+	f.Add([]byte{socks5Version, 0})
+	f.Add([]byte{socks5Version, 2, byte(noAuth), byte(userAuth), socks5Version, byte(AssociateCommand), 0, fqdnAddress, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := &Server{
+			AuthMethods: []AuthMethod{UserAuthMethod(UserAuth("u", "p")), NoAuthMethod()},
+		}
+		req, err := s.handshake(context.Background(), &fuzzConn{r: bytes.NewReader(data)})
+		if err != nil {
+			return
+		}
+		if req.DestinationAddr == nil {
+			t.Fatalf("handshake without destination from %x", data)
+		}
+	})
+}
+
+func FuzzParseSNI(f *testing.F) {
+	f.Add([]byte{tlsHandshakeRecord, 3, 1, 0, 4, tlsClientHello, 0, 0, 0})
+	f.Add([]byte{tlsHandshakeRecord, 3, 1, 255, 255})
+	f.Add([]byte("GET / HTTP/1.1\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		name, ok := parseSNI(data)
+		if ok && (name == "" || len(name) > len(data)) {
+			t.Fatalf("parsed server name %q from %d bytes", name, len(data))
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+var (
+	errGSSAPIAborted = errors.New("gssapi authentication aborted")
+)
+
+const (
+	gssapiVersion = 0x01
+)
+
+const (
+	gssapiAuthMessage         = 0x01
+	gssapiProtectionMessage   = 0x02
+	gssapiEncapsulatedMessage = 0x03
+	gssapiAbortMessage        = 0xff
+)
+
+const (
+	// GSSAPIIntegrity is the per-message integrity protection level
+	GSSAPIIntegrity = 0x01
+	// GSSAPIConfidentiality is the per-message confidentiality protection level
+	GSSAPIConfidentiality = 0x02
+	// GSSAPISelective is the selective integrity or confidentiality protection level
+	GSSAPISelective = 0x03
+)
+
+// GSSAPIAuthenticator GSSAPI authentication as described in RFC 1961
+type GSSAPIAuthenticator interface {
+	// NewSecContext returns a new security context for a connection
+	NewSecContext() GSSAPISecContext
+}
+
+// GSSAPISecContext is the server side of a GSSAPI security context
+type GSSAPISecContext interface {
+	// AcceptSecContext processes a token received from the client,
+	// returns the token to send back if any, and whether the
+	// context is established
+	AcceptSecContext(token []byte) (output []byte, established bool, err error)
+	// Protection selects the message protection level
+	// from the level requested by the client
+	Protection(requested byte) byte
+	// Wrap protects a message to be sent to the client
+	Wrap(msg []byte) ([]byte, error)
+	// Unwrap verifies a message received from the client
+	Unwrap(token []byte) ([]byte, error)
+}
+
+// GSSAPIAuthMethod returns an AuthMethod using GSSAPI authentication
+func GSSAPIAuthMethod(authenticator GSSAPIAuthenticator) AuthMethod {
+	return gssapiAuthMethod{authenticator: authenticator}
+}
+
+type gssapiAuthMethod struct {
+	authenticator GSSAPIAuthenticator
+}
+
+func (m gssapiAuthMethod) Method() byte {
+	return byte(gssapiAuth)
+}
+
+func (m gssapiAuthMethod) Authenticate(conn net.Conn) (net.Conn, string, error) {
+	conn, err := authenticateGSSAPI(conn, m.authenticator)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, "", nil
+}
+
+func authenticateGSSAPI(conn net.Conn, authenticator GSSAPIAuthenticator) (net.Conn, error) {
+	secCtx := authenticator.NewSecContext()
+	for {
+		mtyp, token, err := readGSSAPIMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if mtyp == gssapiAbortMessage {
+			return nil, errGSSAPIAborted
+		}
+		if mtyp != gssapiAuthMessage {
+			writeGSSAPIMessage(conn, gssapiAbortMessage, nil)
+			return nil, fmt.Errorf("unexpected gssapi message type: %d", mtyp)
+		}
+		output, established, err := secCtx.AcceptSecContext(token)
+		if err != nil {
+			writeGSSAPIMessage(conn, gssapiAbortMessage, nil)
+			return nil, fmt.Errorf("%w: %v", ErrUserAuthFailed, err)
+		}
+		if len(output) != 0 {
+			err = writeGSSAPIMessage(conn, gssapiAuthMessage, output)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if established {
+			break
+		}
+	}
+
+	mtyp, token, err := readGSSAPIMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if mtyp != gssapiProtectionMessage {
+		writeGSSAPIMessage(conn, gssapiAbortMessage, nil)
+		return nil, fmt.Errorf("unexpected gssapi message type: %d", mtyp)
+	}
+	requested, err := secCtx.Unwrap(token)
+	if err != nil {
+		writeGSSAPIMessage(conn, gssapiAbortMessage, nil)
+		return nil, err
+	}
+	if len(requested) != 1 {
+		writeGSSAPIMessage(conn, gssapiAbortMessage, nil)
+		return nil, fmt.Errorf("invalid gssapi protection level length: %d", len(requested))
+	}
+	selected, err := secCtx.Wrap([]byte{secCtx.Protection(requested[0])})
+	if err != nil {
+		writeGSSAPIMessage(conn, gssapiAbortMessage, nil)
+		return nil, err
+	}
+	err = writeGSSAPIMessage(conn, gssapiProtectionMessage, selected)
+	if err != nil {
+		return nil, err
+	}
+	return &gssapiConn{Conn: conn, secCtx: secCtx}, nil
+}
+
+func readGSSAPIMessage(r io.Reader) (byte, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	if header[0] != gssapiVersion {
+		return 0, nil, fmt.Errorf("%w: gssapi version %d", ErrUnsupportedVersion, header[0])
+	}
+	if header[1] == gssapiAbortMessage {
+		return header[1], nil, nil
+	}
+	var length [2]byte
+	_, err = io.ReadFull(r, length[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	token := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(r, token)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[1], token, nil
+}
+
+func writeGSSAPIMessage(w io.Writer, mtyp byte, token []byte) error {
+	if mtyp == gssapiAbortMessage {
+		_, err := w.Write([]byte{gssapiVersion, mtyp})
+		return err
+	}
+	if len(token) > 0xffff {
+		return errStringTooLong
+	}
+	buf := make([]byte, 4, 4+len(token))
+	buf[0] = gssapiVersion
+	buf[1] = mtyp
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(token)))
+	_, err := w.Write(append(buf, token...))
+	return err
+}
+
+// gssapiConn encapsulates all traffic in GSSAPI protected messages
+type gssapiConn struct {
+	net.Conn
+	secCtx GSSAPISecContext
+	rest   []byte
+}
+
+// NetConn returns the underlying connection.
+func (c *gssapiConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Read implements the net.Conn Read method.
+func (c *gssapiConn) Read(b []byte) (int, error) {
+	for len(c.rest) == 0 {
+		mtyp, token, err := readGSSAPIMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if mtyp == gssapiAbortMessage {
+			return 0, errGSSAPIAborted
+		}
+		if mtyp != gssapiEncapsulatedMessage {
+			return 0, fmt.Errorf("unexpected gssapi message type: %d", mtyp)
+		}
+		c.rest, err = c.secCtx.Unwrap(token)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+// Write implements the net.Conn Write method.
+func (c *gssapiConn) Write(b []byte) (int, error) {
+	const maxChunk = 32 * 1024
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		token, err := c.secCtx.Wrap(chunk)
+		if err != nil {
+			return n, err
+		}
+		err = writeGSSAPIMessage(c.Conn, gssapiEncapsulatedMessage, token)
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
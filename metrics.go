@@ -0,0 +1,67 @@
+package socks5
+
+import (
+	"errors"
+	"time"
+)
+
+// Metrics receives metrics from the Server,
+// it can be implemented with Prometheus collectors
+type Metrics interface {
+	// IncConnections is called once a request has been parsed
+	// and is about to be handled
+	IncConnections(cmd Command)
+	// DecConnections is called once the handling of a request
+	// that was counted by IncConnections returns
+	DecConnections(cmd Command)
+	// ObserveBytes is called once a CONNECT or BIND tunnel or a UDP
+	// association closes, with the number of bytes sent from and
+	// received by the client, the payloads of datagrams for the latter
+	ObserveBytes(cmd Command, sent, recv int64)
+	// IncErrors is called once for each connection that ends with
+	// an error, closed connections excepted
+	IncErrors(reason string)
+}
+
+// HandshakeMetrics is optionally implemented by Metrics
+// to observe the latency of handshakes
+type HandshakeMetrics interface {
+	// ObserveHandshakeDuration is called once the reply to a SOCKS5
+	// request has been sent, with the time since the connection was
+	// accepted, spent negotiating the method, authenticating if auth,
+	// and reading and serving the request up to the reply, such as
+	// dialing the destination
+	ObserveHandshakeDuration(d time.Duration, auth bool)
+}
+
+// errorReason returns the reason reported to Metrics.IncErrors for err.
+func errorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrHandshakeTimeout):
+		return "handshake_timeout"
+	case errors.Is(err, ErrUserAuthFailed):
+		return "auth_failed"
+	case errors.Is(err, ErrRequestLimited):
+		return "request_limited"
+	case errors.Is(err, ErrQuotaExceeded):
+		return "quota_exceeded"
+	case errors.Is(err, ErrAuthLimited):
+		return "auth_limited"
+	case errors.Is(err, ErrNoSupportedAuth):
+		return "no_acceptable_methods"
+	case errors.Is(err, ErrUnrecognizedAddrType):
+		return "address_type_not_supported"
+	case errors.Is(err, ErrNotAllowed):
+		return "not_allowed"
+	case errors.Is(err, ErrUnsupportedVersion):
+		return "unsupported_version"
+	case errors.Is(err, ErrUnsupportedCommand):
+		return "unsupported_command"
+	case errors.Is(err, ErrProtocolViolation):
+		return "protocol_violation"
+	case isTimeoutError(err):
+		return "timeout"
+	default:
+		return "other"
+	}
+}
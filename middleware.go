@@ -0,0 +1,71 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+)
+
+// Handler serves a request that passed the Rules and Rewrite
+type Handler func(ctx context.Context, req *Request) error
+
+// Middleware wraps a Handler with cross-cutting behavior,
+// such as logging, authorization or metrics
+type Middleware func(next Handler) Handler
+
+// Use appends middleware to the chain wrapping the handling of requests.
+// The first middleware added is the outermost one, it sees requests
+// first and their results last. A middleware failing a request without
+// calling next makes the server reply with a code chosen as for Rewrite.
+// Use is to be called before serving
+func (s *Server) Use(middleware ...Middleware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.middleware = append(s.middleware, middleware...)
+	s.chain = nil
+}
+
+// handler returns the middleware chain, built once, around dispatch.
+func (s *Server) handler() Handler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chain == nil {
+		h := Handler(s.dispatch)
+		for i := len(s.middleware) - 1; i >= 0; i-- {
+			h = s.middleware[i](h)
+		}
+		s.chain = h
+	}
+	return s.chain
+}
+
+// serveRequest runs req through the middleware chain, and replies
+// to the client if a middleware failed it.
+func (s *Server) serveRequest(req *Request) error {
+	ctx := req.Context()
+	err := s.handler()(ctx, req)
+	if err == nil || req.handled {
+		return err
+	}
+	if req.Version == socks4Version {
+		err := s.sendSOCKS4Reply(req.Conn, socks4Rejected, nil)
+		if err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+	} else {
+		err := s.sendReply(req, errToReply(err), nil)
+		if err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+	}
+	return s.onError(ctx, "middleware", req.Conn, err)
+}
+
+// dispatch is the innermost Handler, serving req with ctx.
+func (s *Server) dispatch(ctx context.Context, req *Request) error {
+	req.handled = true
+	req.ctx = ctx
+	if req.Version == socks4Version {
+		return s.handleSOCKS4(req)
+	}
+	return s.handle(req)
+}
@@ -0,0 +1,163 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidProxyProtocol = errors.New("invalid PROXY protocol header")
+)
+
+const (
+	proxyProtocolV1MaxLen = 107
+)
+
+var (
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// readProxyProtocol reads and strips the PROXY protocol v1 or v2 header
+// from conn, and returns a connection reporting the source address
+// it carries as its remote address.
+func readProxyProtocol(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	sig, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	var remoteAddr net.Addr
+	switch {
+	case bytes.Equal(sig, proxyProtocolV2Signature):
+		remoteAddr, err = readProxyProtocolV2(r)
+	case bytes.HasPrefix(sig, proxyProtocolV1Prefix):
+		remoteAddr, err = readProxyProtocolV1(r)
+	default:
+		return nil, errInvalidProxyProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remoteAddr == nil {
+		remoteAddr = conn.RemoteAddr()
+	}
+	return &proxyProtocolConn{Conn: conn, r: r, remoteAddr: remoteAddr}, nil
+}
+
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyProtocolV1MaxLen {
+			return nil, errInvalidProxyProtocol
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidProxyProtocol
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return nil, errInvalidProxyProtocol
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errInvalidProxyProtocol
+	}
+	if len(fields) != 6 {
+		return nil, errInvalidProxyProtocol
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, errInvalidProxyProtocol
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errInvalidProxyProtocol
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 0x2 {
+		return nil, errInvalidProxyProtocol
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errInvalidProxyProtocol
+	}
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errInvalidProxyProtocol
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errInvalidProxyProtocol
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// proxyProtocolConn is a net.Conn whose PROXY protocol header was read.
+type proxyProtocolConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+// NetConn returns the underlying connection.
+func (c *proxyProtocolConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Read implements the net.Conn Read method.
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if c.r.Buffered() != 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the source address carried by the PROXY protocol header.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
@@ -0,0 +1,111 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Quota limits the bytes relayed for each authenticated user
+type Quota interface {
+	// Check reports whether user may make a new request,
+	// or relay more bytes in a tunnel or association
+	Check(user string) bool
+	// Add records the bytes sent from and received by user
+	// as they are relayed
+	Add(user string, sent, received int64)
+}
+
+// NewQuota returns an in-memory Quota allowing each user to relay
+// limit bytes in both directions, over each period if not zero,
+// starting from the first bytes relayed, or in total otherwise
+func NewQuota(limit int64, period time.Duration) Quota {
+	return &quota{
+		limit:  limit,
+		period: period,
+		usage:  map[string]*quotaUsage{},
+	}
+}
+
+type quotaUsage struct {
+	bytes int64
+	start time.Time
+}
+
+type quota struct {
+	limit  int64
+	period time.Duration
+
+	mu    sync.Mutex
+	usage map[string]*quotaUsage
+}
+
+func (q *quota) Check(user string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.current(user, time.Now())
+	return u == nil || u.bytes < q.limit
+}
+
+func (q *quota) Add(user string, sent, received int64) {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.current(user, now)
+	if u == nil {
+		u = &quotaUsage{start: now}
+		q.usage[user] = u
+	}
+	u.bytes += sent + received
+}
+
+// quotaConn is a net.Conn to a client that charges the bytes read
+// from and written to Conn to user, and fails once user is over quota.
+type quotaConn struct {
+	net.Conn
+	quota Quota
+	user  string
+}
+
+// NetConn returns the underlying connection.
+func (c *quotaConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Read implements the net.Conn Read method.
+func (c *quotaConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.quota.Add(c.user, int64(n), 0)
+		if err == nil && !c.quota.Check(c.user) {
+			err = fmt.Errorf("%w: %q", ErrQuotaExceeded, c.user)
+		}
+	}
+	return n, err
+}
+
+// Write implements the net.Conn Write method.
+func (c *quotaConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.quota.Add(c.user, 0, int64(n))
+		if err == nil && !c.quota.Check(c.user) {
+			err = fmt.Errorf("%w: %q", ErrQuotaExceeded, c.user)
+		}
+	}
+	return n, err
+}
+
+// current returns the usage of user in the current period, if any.
+func (q *quota) current(user string, now time.Time) *quotaUsage {
+	u, ok := q.usage[user]
+	if !ok {
+		return nil
+	}
+	if q.period > 0 && now.Sub(u.start) >= q.period {
+		delete(q.usage, user)
+		return nil
+	}
+	return u
+}
@@ -0,0 +1,149 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter limits the rate at which bytes are transferred.
+// *rate.Limiter from golang.org/x/time/rate satisfies it
+type Limiter interface {
+	// Burst returns the maximum number of bytes allowed at once
+	Burst() int
+	// WaitN blocks until n bytes may be transferred or ctx is done
+	WaitN(ctx context.Context, n int) error
+}
+
+// RateLimit specifies the throughput limit of each tunnel
+type RateLimit struct {
+	// BytesPerSecond is the sustained number of bytes per second,
+	// zero or less means unlimited
+	BytesPerSecond int
+	// Burst is the maximum number of bytes transferred at once,
+	// defaults to BytesPerSecond
+	Burst int
+	// PerDirection limits each direction of a tunnel independently,
+	// otherwise the combined flow of both directions is limited
+	PerDirection bool
+	// NewLimiter optionally specifies the function creating the Limiter,
+	// by default a token bucket is used
+	NewLimiter func(bytesPerSecond, burst int) Limiter
+}
+
+func (r *RateLimit) newLimiter() Limiter {
+	burst := r.Burst
+	if burst <= 0 {
+		burst = r.BytesPerSecond
+	}
+	if r.NewLimiter != nil {
+		return r.NewLimiter(r.BytesPerSecond, burst)
+	}
+	return NewTokenBucket(r.BytesPerSecond, burst)
+}
+
+// wrap wraps c1 and c2 so that reading from them is rate limited.
+func (r *RateLimit) wrap(ctx context.Context, c1, c2 net.Conn) (net.Conn, net.Conn) {
+	if r.BytesPerSecond <= 0 {
+		return c1, c2
+	}
+	l1 := r.newLimiter()
+	l2 := l1
+	if r.PerDirection {
+		l2 = r.newLimiter()
+	}
+	return &rateLimitedConn{Conn: c1, ctx: ctx, limiter: l1}, &rateLimitedConn{Conn: c2, ctx: ctx, limiter: l2}
+}
+
+type rateLimitedConn struct {
+	net.Conn
+	ctx     context.Context
+	limiter Limiter
+}
+
+// NetConn returns the underlying connection.
+func (c *rateLimitedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Read implements the net.Conn Read method.
+func (c *rateLimitedConn) Read(b []byte) (int, error) {
+	if burst := c.limiter.Burst(); burst > 0 && len(b) > burst {
+		b = b[:burst]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if werr := c.limiter.WaitN(c.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// NewTokenBucket returns a token bucket Limiter that allows
+// bytesPerSecond bytes per second with bursts of at most burst bytes.
+// A bytesPerSecond of zero or less does not limit,
+// and a burst of zero or less defaults to bytesPerSecond
+func NewTokenBucket(bytesPerSecond, burst int) Limiter {
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	return &tokenBucket{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) Burst() int {
+	return b.burst
+}
+
+func (b *tokenBucket) WaitN(ctx context.Context, n int) error {
+	if b.rate <= 0 {
+		return nil
+	}
+	if n > b.burst {
+		return fmt.Errorf("wait %d exceeds burst %d", n, b.burst)
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens += float64(n)
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
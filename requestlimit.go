@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RequestLimiter limits the rate of new connections, per client for example
+type RequestLimiter interface {
+	// Allow reports whether a new connection from a client may be served
+	Allow(addr net.Addr) bool
+}
+
+// RequestLimiterFunc RequestLimiter interface is implemented
+type RequestLimiterFunc func(addr net.Addr) bool
+
+// Allow limiter processing
+func (f RequestLimiterFunc) Allow(addr net.Addr) bool {
+	return f(addr)
+}
+
+// NewRequestLimiter returns an in-memory RequestLimiter that allows each
+// client IP requestsPerSecond connections per second, with bursts of
+// at most burst connections
+func NewRequestLimiter(requestsPerSecond float64, burst int) RequestLimiter {
+	return &requestLimiter{
+		rate:    requestsPerSecond,
+		burst:   float64(burst),
+		buckets: map[string]*requestBucket{},
+	}
+}
+
+type requestBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type requestLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*requestBucket
+	lastPrune time.Time
+}
+
+func (l *requestLimiter) Allow(addr net.Addr) bool {
+	key := ipKey(addr)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &requestBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets the clients whose bucket has refilled.
+func (l *requestLimiter) prune(now time.Time) {
+	if l.rate <= 0 {
+		return
+	}
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastPrune) < refill {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
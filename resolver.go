@@ -0,0 +1,19 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+// NameResolverFunc NameResolver interface is implemented
+type NameResolverFunc func(ctx context.Context, name string) (net.IP, error)
+
+// Resolve name resolution
+func (f NameResolverFunc) Resolve(ctx context.Context, name string) (net.IP, error) {
+	return f(ctx, name)
+}
+
+// NameResolver is used to resolve domain names
+type NameResolver interface {
+	Resolve(ctx context.Context, name string) (net.IP, error)
+}
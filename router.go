@@ -0,0 +1,23 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+// ProxyDialFunc dials address on network, like Server.ProxyDial
+type ProxyDialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// RouterFunc Router interface is implemented
+type RouterFunc func(ctx context.Context, req *Request) ProxyDialFunc
+
+// SelectDialer dialer selection
+func (f RouterFunc) SelectDialer(ctx context.Context, req *Request) ProxyDialFunc {
+	return f(ctx, req)
+}
+
+// Router is used to select the dialer of a request's destination,
+// returning nil to use the default one
+type Router interface {
+	SelectDialer(ctx context.Context, req *Request) ProxyDialFunc
+}
@@ -0,0 +1,128 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+// RuleSetFunc RuleSet interface is implemented
+type RuleSetFunc func(ctx context.Context, req *Request) bool
+
+// Allow rule processing
+func (f RuleSetFunc) Allow(ctx context.Context, req *Request) bool {
+	return f(ctx, req)
+}
+
+// RuleSet is used to allow or deny requests
+type RuleSet interface {
+	Allow(ctx context.Context, req *Request) bool
+}
+
+// ReplyRuleSetFunc ReplyRuleSet interface is implemented
+type ReplyRuleSetFunc func(ctx context.Context, req *Request) Reply
+
+// Allow rule processing
+func (f ReplyRuleSetFunc) Allow(ctx context.Context, req *Request) bool {
+	return f(ctx, req) == SuccessReply
+}
+
+// AllowReply rule processing
+func (f ReplyRuleSetFunc) AllowReply(ctx context.Context, req *Request) Reply {
+	return f(ctx, req)
+}
+
+// ReplyRuleSet is optionally implemented by a RuleSet to choose
+// the reply code sent for denied requests
+type ReplyRuleSet interface {
+	RuleSet
+	// AllowReply returns SuccessReply to allow a request,
+	// or the reply code to deny it with
+	AllowReply(ctx context.Context, req *Request) Reply
+}
+
+// allow returns the reply code to deny req with, or SuccessReply.
+func allow(ctx context.Context, rules RuleSet, req *Request) Reply {
+	if r, ok := rules.(ReplyRuleSet); ok {
+		return r.AllowReply(ctx, req)
+	}
+	if !rules.Allow(ctx, req) {
+		return RuleFailureReply
+	}
+	return SuccessReply
+}
+
+// defaultPrivateNetworks are the loopback, link-local, private
+// and otherwise non-public networks blocked by BlockPrivateDestinations.
+var defaultPrivateNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func (s *Server) filtersNetworks() bool {
+	return len(s.AllowedNetworks) != 0 || len(s.DeniedNetworks) != 0 || s.BlockPrivateDestinations
+}
+
+// allowedIP reports whether ip is in none of the DeniedNetworks,
+// nor of the private networks if blocked, and in one of the
+// AllowedNetworks if any.
+func (s *Server) allowedIP(ip net.IP) bool {
+	for _, n := range s.DeniedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if s.BlockPrivateDestinations {
+		privateNetworks := s.PrivateNetworks
+		if privateNetworks == nil {
+			privateNetworks = defaultPrivateNetworks
+		}
+		for _, n := range privateNetworks {
+			if n.Contains(ip) {
+				return false
+			}
+		}
+	}
+	if len(s.AllowedNetworks) == 0 {
+		return true
+	}
+	for _, n := range s.AllowedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedPort reports whether port is one of the AllowedPorts if any.
+func (s *Server) allowedPort(port int) bool {
+	if len(s.AllowedPorts) == 0 {
+		return true
+	}
+	for _, p := range s.AllowedPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
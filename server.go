@@ -3,39 +3,336 @@ package socks5
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// ErrServerClosed is returned by the Server's Serve and ListenAndServe
+// methods after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("socks5: Server closed")
+
+// ErrHandshakeTimeout is returned when a client does not complete
+// method negotiation, authentication and the request within
+// the Server's HandshakeTimeout.
+var ErrHandshakeTimeout = errors.New("socks5: handshake timeout")
+
 // Server is accepting connections and handling the details of the SOCKS5 protocol
 type Server struct {
 	// Authentication is proxy authentication
 	Authentication Authentication
+	// GSSAPIAuthenticator is GSSAPI proxy authentication,
+	// preferred over Authentication if the client offers both
+	GSSAPIAuthenticator GSSAPIAuthenticator
+	// Rules is used to allow or deny requests after they are parsed
+	Rules RuleSet
+	// AuthMethods is the ordered list of authentication methods to accept,
+	// the first one offered by the client is selected, whatever the order
+	// of the client's offer. If nil, it is derived from GSSAPIAuthenticator
+	// and Authentication, preferring GSSAPI over username/password,
+	// and no authentication only if neither is set
+	AuthMethods []AuthMethod
+	// AuthRequired optionally decides for each connection whether it must
+	// authenticate. Connections not required to, such as from trusted IPs,
+	// may then use no authentication if they do not offer another method.
+	// Connections required to never may. The default is AuthMethods as is
+	AuthRequired func(conn net.Conn) bool
+	// AllowedNetworks optionally restricts the destinations of CONNECT
+	// and of ASSOCIATE datagrams to these networks, once resolved.
+	// Names passed through to a custom dialer with PassThroughNames
+	// are not checked
+	AllowedNetworks []*net.IPNet
+	// AllowedPorts optionally restricts the destination ports of CONNECT
+	// and of ASSOCIATE datagrams, such as to 80 and 443.
+	// Empty means all ports are allowed
+	AllowedPorts []int
+	// DeniedNetworks are networks that destinations may not be in,
+	// such as 127.0.0.0/8 or 169.254.0.0/16, once resolved
+	DeniedNetworks []*net.IPNet
+	// BlockPrivateDestinations denies destinations in the PrivateNetworks
+	// once resolved, to protect hosts and cloud metadata endpoints
+	// reachable from the server from its clients
+	BlockPrivateDestinations bool
+	// PrivateNetworks are the networks denied by BlockPrivateDestinations.
+	// If nil, the loopback, link-local, private and shared address
+	// networks of IPv4 and IPv6 are used
+	PrivateNetworks []*net.IPNet
+	// AuthLimiter optionally limits authentication attempts,
+	// clients it blocks are answered with no acceptable methods
+	AuthLimiter AuthLimiter
+	// EnabledCommands is the list of commands to serve, others are
+	// answered with a command not supported reply.
+	// If empty, all commands are enabled
+	EnabledCommands []Command
+	// AllowUnspecifiedDestination accepts CONNECT requests to port 0
+	// or to an unspecified IP, which are rejected by default.
+	// BIND and ASSOCIATE requests may always use wildcard addresses
+	AllowUnspecifiedDestination bool
+	// Resolver optionally resolves domain name destinations,
+	// otherwise names are passed to ProxyDial as is
+	Resolver NameResolver
+	// PassThroughNames passes domain name destinations of CONNECT to
+	// ProxyDial unresolved even if Resolver is set, so that an upstream
+	// proxy dialed with a socks5h Dialer receives the name.
+	// AllowedNetworks, DeniedNetworks and BlockPrivateDestinations do
+	// not apply to names passed through, so with the default ProxyDial,
+	// which would only resolve them itself, names are still resolved
+	// and checked. Resolver is still used for ASSOCIATE
+	PassThroughNames bool
 	// ProxyDial specifies the optional proxyDial function for
 	// establishing the transport connection.
 	ProxyDial func(ctx context.Context, network string, address string) (net.Conn, error)
+	// Router optionally selects the function dialing the destination of
+	// a CONNECT, such as to reach some networks directly and the others
+	// through an upstream proxy. ProxyDial is used if it returns nil
+	Router Router
 	// ProxyListen specifies the optional proxyListen function for
 	// establishing the transport connection.
 	ProxyListen func(context.Context, string, string) (net.Listener, error)
+	// ListenConfig configures the listening socket of ListenAndServe and
+	// Listen when ProxyListen is nil, such as its keep-alive period or a
+	// Control function setting SO_REUSEPORT. The listen backlog is the
+	// system's. The zero value listens as net.Listen does
+	ListenConfig net.ListenConfig
 	// ProxyListenPacket specifies the optional proxyListenPacket function for
 	// establishing the transport connection.
 	ProxyListenPacket func(ctx context.Context, network string, address string) (net.PacketConn, error)
+	// AdvertisedAddr optionally overrides the address sent in success
+	// replies, e.g. with the externally visible address behind NAT.
+	// It receives and should return a *net.TCPAddr for CONNECT and BIND,
+	// and a *net.UDPAddr for ASSOCIATE, or an *Address with a Name
+	// of at most 255 bytes to reply with a domain name
+	AdvertisedAddr func(local net.Addr) net.Addr
+	// UDPAdvertisedIP optionally overrides the IP sent in ASSOCIATE replies,
+	// by default the local IP of the control connection is used
+	// if the relay is bound to an unspecified address
+	UDPAdvertisedIP net.IP
 	// PacketForwardAddress specifies the packet forwarding address
 	PacketForwardAddress func(ctx context.Context, destinationAddr string, packet net.PacketConn, conn net.Conn) (net.IP, int, error)
 	// Logger error log
 	Logger Logger
+	// Slog optionally receives structured records of accepted connections,
+	// authentication results, dialed targets, transferred bytes and errors
+	Slog SlogLogger
+	// ProxyProtocol reads the PROXY protocol v1 or v2 header sent by
+	// a load balancer before the handshake, so that the real client
+	// address is used as the RemoteAddr of requests
+	ProxyProtocol bool
+	// ConnContext optionally modifies the context used for a connection,
+	// its requests, dials and hooks. It is called once the PROXY protocol
+	// header is read if any, and a nil context keeps the original one
+	ConnContext func(ctx context.Context, conn net.Conn) context.Context
+	// RequestLimiter optionally limits the rate of new connections,
+	// connections over the limit are closed before the handshake
+	RequestLimiter RequestLimiter
+	// OnConnect is optionally called once a connection is accepted,
+	// before the SOCKS handshake. Returning an error closes the connection,
+	// and the returned connection is used for the rest of the session,
+	// a nil connection keeps the original one
+	OnConnect func(ctx context.Context, conn net.Conn) (net.Conn, error)
+	// AllowSOCKS4 also serves SOCKS4 and SOCKS4a CONNECT and BIND requests,
+	// unless authentication is required as SOCKS4 has none
+	AllowSOCKS4 bool
+	// Fallback optionally serves the connections that do not start
+	// with the SOCKS5 version, such as HTTP on the same port.
+	// conn still returns the bytes read to detect the protocol
+	Fallback func(ctx context.Context, conn net.Conn) error
+	// Rewrite optionally changes the destination of a request after Rules
+	// allowed it. A nil address keeps the destination, and an error fails
+	// the request with a reply, whose code may be chosen with NewReplyError.
+	// The address in a success reply is still the one bound for the
+	// destination actually used, see AdvertisedAddr
+	Rewrite func(ctx context.Context, req *Request) (*Address, error)
+	// OnError is optionally called with the phase a connection failed in,
+	// one of "connect", "handshake", "fallback", "auth", "rules", "rewrite",
+	// "quota", "middleware", "command", "dial", "bind", "associate", "reply",
+	// "tunnel" or "panic" when serving the connection panicked.
+	// It complements Logger
+	OnError func(ctx context.Context, phase string, conn net.Conn, err error)
 	// Context is default context
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool BytesPool
+	// BufferSize is the size of the buffers used by io.CopyBuffer
+	// if BytesPool is nil. The default is 32KiB
+	BufferSize int
+	// Tunnel optionally relays the bytes of a CONNECT or BIND in both
+	// directions between dst, the destination, and src, the client, until
+	// either is done, instead of the built-in copy. It may inspect or
+	// transform the stream. BytesPool and BufferSize are then not used
+	// unless Tunnel uses them itself
+	Tunnel func(ctx context.Context, dst, src net.Conn) error
+	// RateLimit optionally limits the throughput of each tunnel
+	RateLimit *RateLimit
+	// OnConnClose is optionally called when a CONNECT or BIND tunnel closes,
+	// with the number of bytes sent from and received by the client
+	OnConnClose func(req *Request, sent, received int64, err error)
+	// OnAssociate is optionally called when a UDP association starts relaying
+	OnAssociate func(req *Request)
+	// OnAssociateClose is optionally called when a UDP association ends,
+	// with the datagrams and bytes relayed from and to the client
+	OnAssociateClose func(req *Request, counts AssociateCounts, err error)
+	// Quota optionally limits the bytes relayed for each user, requests
+	// of a user over quota are denied with RuleFailureReply, and its
+	// tunnels and associations are closed once it goes over quota.
+	// Clients without authentication share the empty username
+	Quota Quota
+	// AccessLog is optionally called with an entry for each request
+	// once it is done, whether it succeeded or not
+	AccessLog func(entry AccessLogEntry)
+	// Metrics optionally receives connection, traffic and error metrics
+	Metrics Metrics
+	// MaxConnections is the maximum number of connections served
+	// concurrently. The default is no limit
+	MaxConnections int
+	// MaxConnectionsBehavior is what Serve does once MaxConnections is reached
+	MaxConnectionsBehavior MaxConnectionsBehavior
+	// AcceptGate is called by Serve for each accepted connection,
+	// before MaxConnections is applied, such as to shed load under
+	// memory pressure. Connections it returns false for are closed
+	// at once, without being served
+	AcceptGate func() bool
+	// LocalIP is the source IP of the default ProxyDial, and the IP
+	// the default ProxyListenPacket and BIND listen on, for source-based
+	// routing.
+	// Destinations of the other IP family are then unreachable
+	LocalIP net.IP
+	// Control is optionally called by the default ProxyDial and
+	// ProxyListenPacket, and by BIND, on sockets before they are used,
+	// to set socket options, such as with MarkControl on Linux
+	Control func(network, address string, c syscall.RawConn) error
+	// UDPPortRange is the inclusive range of ports the default
+	// ProxyListenPacket listens on for associations, such as to match
+	// firewall pinholes. The default is a port chosen by the system
+	UDPPortRange [2]int
+	// DialRetries is the number of times a CONNECT retries to dial
+	// the destination after a timeout or temporary error,
+	// within the DialTimeout. The default is no retries
+	DialRetries int
+	// DialRetryBackoff is the delay before the first retry,
+	// doubled before each next one
+	DialRetryBackoff time.Duration
+	// FallbackDelay is how long the default dialer waits for a
+	// destination name's preferred address family before racing the other
+	// one, as in RFC 8305. It does not apply when Resolver returns one IP.
+	// The default is 300ms, and a negative value dials addresses serially
+	FallbackDelay time.Duration
+	// DialTimeout is the maximum amount of time a CONNECT may take
+	// to dial the destination. The default is no timeout
+	DialTimeout time.Duration
+	// IdleTimeout is the maximum amount of time a tunnel may stay open
+	// without bytes moving in either direction. The default is no timeout
+	IdleTimeout time.Duration
+	// DrainTimeout is the maximum amount of time Close lets tunnels
+	// write the bytes they already read before closing them, so that
+	// transfers in flight are not truncated mid-write.
+	// The default is to close them at once
+	DrainTimeout time.Duration
+	// KeepAlivePeriod enables TCP keep-alives with this period on both
+	// connections of CONNECT and BIND tunnels, so that NAT devices do not
+	// drop idle long-lived sessions. The default leaves them unchanged
+	KeepAlivePeriod time.Duration
+	// DisableNoDelay enables Nagle's algorithm on both connections of
+	// CONNECT and BIND tunnels, batching small writes for bulk transfers.
+	// The default keeps it disabled, as Go does, for interactive traffic
+	DisableNoDelay bool
+	// HandshakeTimeout is the maximum amount of time a client may take
+	// to send its PROXY protocol header if any, negotiate a method,
+	// authenticate and send its request.
+	// The default is no timeout
+	HandshakeTimeout time.Duration
+	// UDPTimeout is the maximum amount of time an association may stay
+	// open without datagrams. The default is no timeout
+	UDPTimeout time.Duration
+	// StrictUDPSource only accepts datagrams of an association from
+	// the IP address of the client's control connection, and from the
+	// port requested by the client if any
+	StrictUDPSource bool
+	// StrictProtocol rejects requests, and drops datagrams of
+	// associations, whose reserved fields are not zero, for interop
+	// debugging, instead of ignoring them. The method selection and
+	// authentication sub-negotiations have no reserved fields
+	StrictProtocol bool
+	// StrictBindPeer makes BIND listen on a port of its own, and only
+	// accept the inbound connection from the IP of the destination in the
+	// request, the peer expected by the client, instead of from anyone
+	StrictBindPeer bool
+	// BindTimeout is the maximum amount of time to wait for the inbound
+	// connection of a BIND. The default is no timeout
+	BindTimeout time.Duration
+	// MaxUDPPacketSize is the maximum size of the datagrams relayed by
+	// an association, larger ones are dropped and counted in Stats.
+	// The default is 65507 bytes, the largest UDP payload over IPv4
+	MaxUDPPacketSize int
+	// MaxUDPFragmentAge is the maximum amount of time to wait for all
+	// fragments of a fragmented UDP datagram to arrive.
+	// Fragmented datagrams are reassembled if it is set,
+	// otherwise they are dropped
+	MaxUDPFragmentAge time.Duration
+	// OnUDPDatagram is optionally called with each datagram, reassembled,
+	// that a client sends through an association to dst, such as to block
+	// DNS queries for some domains. Returning false drops the datagram.
+	// payload is only valid during the call
+	OnUDPDatagram func(ctx context.Context, src net.Addr, dst *Address, payload []byte) (forward bool)
+	// InspectSNI reads the TLS ClientHello a client sends first through
+	// a CONNECT tunnel, without terminating TLS, to pass its server name
+	// to OnSNI and log it before forwarding it. Tunnels of other traffic
+	// are forwarded unchanged
+	InspectSNI bool
+	// OnSNI is optionally called with the server name of a CONNECT tunnel
+	// when InspectSNI is set. Returning false closes the tunnel before
+	// the ClientHello reaches the target
+	OnSNI func(req *Request, serverName string) (allow bool)
+	// OnDrained is optionally called once the last connection finished
+	// after Shutdown or Close, or by them if there was none, such as to
+	// let an orchestrator stop the old process of a graceful restart
+	OnDrained func()
+
+	mu         sync.Mutex
+	listeners  map[*net.Listener]struct{}
+	activeConn map[net.Conn]context.CancelFunc
+	numConns   int
+	inShutdown bool
+	drained    bool
+	connWG     sync.WaitGroup
+	connSem    chan struct{}
+	middleware []Middleware
+	chain      Handler
+	stats      serverStats
 }
 
+// MaxConnectionsBehavior is what Serve does once MaxConnections is reached
+type MaxConnectionsBehavior int
+
+const (
+	// MaxConnectionsBlock stops accepting until a connection finishes
+	MaxConnectionsBlock MaxConnectionsBehavior = iota
+	// MaxConnectionsReject accepts and immediately closes new connections
+	MaxConnectionsReject
+)
+
 type Logger interface {
 	Println(v ...interface{})
 }
 
+// SlogLogger is a leveled, structured logger,
+// *slog.Logger from log/slog satisfies it
+type SlogLogger interface {
+	DebugContext(ctx context.Context, msg string, args ...interface{})
+	InfoContext(ctx context.Context, msg string, args ...interface{})
+	WarnContext(ctx context.Context, msg string, args ...interface{})
+	ErrorContext(ctx context.Context, msg string, args ...interface{})
+}
+
 // NewServer creates a new Server
 func NewServer() *Server {
 	return &Server{}
@@ -43,17 +340,39 @@ func NewServer() *Server {
 
 // ListenAndServe is used to create a listener and serve on it
 func (s *Server) ListenAndServe(network, addr string) error {
-	l, err := s.proxyListen(s.context(), network, addr)
+	l, err := s.Listen(network, addr)
 	if err != nil {
 		return err
 	}
 	return s.Serve(l)
 }
 
+// Listen creates a listener with the server's ProxyListen, such as to
+// learn the address chosen for port 0 before calling Serve with it
+func (s *Server) Listen(network, addr string) (net.Listener, error) {
+	return s.proxyListen(s.context(), network, addr)
+}
+
+// ListenAndServeTLS is used to create a listener and serve
+// SOCKS5 over TLS on it
+func (s *Server) ListenAndServeTLS(network, addr string, config *tls.Config) error {
+	l, err := s.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(l, config)
+}
+
+// ServeTLS is used to serve SOCKS5 over TLS from a listener,
+// the TLS handshake is subject to the HandshakeTimeout
+func (s *Server) ServeTLS(l net.Listener, config *tls.Config) error {
+	return s.Serve(tls.NewListener(l, config))
+}
+
 func (s *Server) proxyListen(ctx context.Context, network, address string) (net.Listener, error) {
 	proxyListen := s.ProxyListen
 	if proxyListen == nil {
-		var listenConfig net.ListenConfig
+		listenConfig := s.ListenConfig
 		proxyListen = listenConfig.Listen
 	}
 	return proxyListen(ctx, network, address)
@@ -61,9 +380,20 @@ func (s *Server) proxyListen(ctx context.Context, network, address string) (net.
 
 // Serve is used to serve connections from a listener
 func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(&l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(&l, false)
+
+	sem := s.connSemaphore()
 	stop := make(chan error)
 	next := make(chan net.Conn)
 	for {
+		if sem != nil && s.MaxConnectionsBehavior == MaxConnectionsBlock {
+			// Only the Accept below reports on stop,
+			// connections release their slot however they end.
+			sem <- struct{}{}
+		}
 		go func() {
 			if conn, err := l.Accept(); err != nil {
 				stop <- err
@@ -74,245 +404,759 @@ func (s *Server) Serve(l net.Listener) error {
 		select {
 		case err := <-stop:
 			_ = l.Close()
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		case conn := <-next:
-			go s.ServeConn(conn, stop)
+			if s.AcceptGate != nil && !s.AcceptGate() {
+				conn.Close()
+				if sem != nil && s.MaxConnectionsBehavior == MaxConnectionsBlock {
+					<-sem
+				}
+				if s.Logger != nil {
+					s.Logger.Println(fmt.Errorf("reject connection from %s: refused by accept gate", conn.RemoteAddr()))
+				}
+				continue
+			}
+			if sem != nil && s.MaxConnectionsBehavior == MaxConnectionsReject {
+				select {
+				case sem <- struct{}{}:
+				default:
+					conn.Close()
+					if s.Logger != nil {
+						s.Logger.Println(fmt.Errorf("reject connection from %s: too many connections", conn.RemoteAddr()))
+					}
+					continue
+				}
+			}
+			go func() {
+				s.ServeConn(conn, stop)
+				if sem != nil {
+					<-sem
+				}
+			}()
 		}
 	}
 }
 
+func (s *Server) connSemaphore() chan struct{} {
+	if s.MaxConnections <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connSem == nil {
+		s.connSem = make(chan struct{}, s.MaxConnections)
+	}
+	return s.connSem
+}
+
 // ServeConn is used to serve a single connection.
+// stop is not used, the errors of a single connection do not stop Serve
 func (s *Server) ServeConn(conn net.Conn, stop chan error) {
-	defer conn.Close()
-	err := s.serveConn(conn)
-	if err != nil && s.Logger != nil && !isClosedConnError(err) {
-		s.Logger.Println(err)
+	s.serveConnContext(s.context(), conn)
+}
+
+// ServeConnContext is used to serve a single connection with ctx,
+// instead of the Server's default context.
+func (s *Server) ServeConnContext(ctx context.Context, conn net.Conn) {
+	s.serveConnContext(ctx, conn)
+}
+
+// Pipe returns the client side of an in-memory connection to the server,
+// whose other side is served in the background, for tests without sockets
+func (s *Server) Pipe() net.Conn {
+	client, server := net.Pipe()
+	go s.ServeConnContext(s.context(), server)
+	return client
+}
+
+// HandleConn serves conn synchronously, from the handshake to the end
+// of the tunnel, and returns the error it failed with instead of
+// logging it, for custom accept loops such as of multiplexed transports.
+// The connection is closed once HandleConn returns
+func (s *Server) HandleConn(ctx context.Context, conn net.Conn) error {
+	err := s.serveTrackedConn(withConnID(ctx), conn)
+	if failed(err) && s.Metrics != nil {
+		s.Metrics.IncErrors(errorReason(err))
 	}
-	if errors.Is(err, io.EOF) {
-		stop <- err
+	return err
+}
+
+func (s *Server) serveConnContext(ctx context.Context, conn net.Conn) error {
+	ctx = withConnID(ctx)
+	err := s.HandleConn(ctx, conn)
+	if failed(err) {
+		s.logError(ctx, err)
 	}
+	return err
 }
 
-func (s *Server) serveConn(conn net.Conn) error {
-	version, err := readByte(conn)
-	if err != nil {
+// failed reports whether err from serving a connection is a failure,
+// rather than the connection or the server being closed.
+func failed(err error) bool {
+	return err != nil && !isClosedConnError(err) && !errors.Is(err, ErrServerClosed)
+}
+
+func (s *Server) serveTrackedConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if !s.trackConn(conn, cancel, true) {
+		return ErrServerClosed
+	}
+	defer s.trackConn(conn, nil, false)
+	s.stats.connOpened()
+	defer s.stats.connClosed()
+	return s.serveConnRecover(ctx, conn)
+}
+
+// serveConnRecover serves conn, turning a panic, such as in a hook or
+// a custom ProxyDial, into an error so that the server keeps running.
+func (s *Server) serveConnRecover(ctx context.Context, conn net.Conn) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.onError(ctx, "panic", conn, fmt.Errorf("panic serving %v: %v\n%s", conn.RemoteAddr(), r, debug.Stack()))
+		}
+	}()
+	return s.serveConn(ctx, conn)
+}
+
+// Shutdown gracefully shuts down the server without interrupting any
+// active connections. Shutdown works by first closing all open
+// listeners and then waiting indefinitely for connections to finish.
+// If the provided context expires before the shutdown is complete,
+// Shutdown returns the context's error, otherwise it returns any
+// error returned from closing the Server's underlying Listener(s).
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	err := s.closeListenersLocked()
+	drained := s.drainedLocked()
+	s.mu.Unlock()
+	if drained {
+		s.OnDrained()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
 		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	if version != socks5Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", version)
+}
+
+// Close immediately closes all active net.Listeners and any
+// connections in flight, after letting their tunnels drain
+// for up to DrainTimeout if set.
+// For a graceful shutdown, use Shutdown.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.inShutdown = true
+	err := s.closeListenersLocked()
+	var draining []net.Conn
+	for c, cancel := range s.activeConn {
+		if s.DrainTimeout > 0 {
+			cancel()
+			draining = append(draining, c)
+		} else {
+			c.Close()
+		}
+		delete(s.activeConn, c)
+	}
+	if len(draining) != 0 {
+		time.AfterFunc(s.DrainTimeout, func() {
+			for _, c := range draining {
+				c.Close()
+			}
+		})
+	}
+	drained := s.drainedLocked()
+	s.mu.Unlock()
+	if drained {
+		s.OnDrained()
 	}
+	return err
+}
+
+// ActiveConns returns the number of connections being served,
+// including those closed by Close that did not finish yet
+func (s *Server) ActiveConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.numConns
+}
 
-	req := &request{
-		Version: socks5Version,
-		Conn:    conn,
+// drainedLocked reports whether OnDrained is to be called now,
+// that is once the server is shut down without connections.
+func (s *Server) drainedLocked() bool {
+	if !s.inShutdown || s.numConns != 0 || s.drained || s.OnDrained == nil {
+		return false
 	}
+	s.drained = true
+	return true
+}
 
-	methods, err := readBytes(conn)
-	if err != nil {
-		return err
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for ln := range s.listeners {
+		if cerr := (*ln).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
 	}
+	return err
+}
 
-	if s.Authentication != nil && bytes.IndexByte(methods, byte(userAuth)) != -1 {
-		_, err := conn.Write([]byte{socks5Version, byte(userAuth)})
-		if err != nil {
-			return err
+// trackListener adds or removes a net.Listener to the set of tracked
+// listeners. It reports whether the server is still up (not Shutdown
+// or Closed).
+func (s *Server) trackListener(ln *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[*net.Listener]struct{})
+	}
+	if add {
+		if s.inShutdown {
+			return false
 		}
+		s.listeners[ln] = struct{}{}
+	} else {
+		delete(s.listeners, ln)
+	}
+	return true
+}
+
+// trackConn adds or removes a connection to the set of active
+// connections. It reports whether the server is still up (not Shutdown
+// or Closed).
+func (s *Server) trackConn(c net.Conn, cancel context.CancelFunc, add bool) bool {
+	s.mu.Lock()
+	if s.activeConn == nil {
+		s.activeConn = make(map[net.Conn]context.CancelFunc)
+	}
+	if add {
+		defer s.mu.Unlock()
+		if s.inShutdown {
+			return false
+		}
+		s.activeConn[c] = cancel
+		s.numConns++
+		s.connWG.Add(1)
+		return true
+	}
+	delete(s.activeConn, c)
+	s.numConns--
+	drained := s.drainedLocked()
+	s.mu.Unlock()
+	if drained {
+		s.OnDrained()
+	}
+	s.connWG.Done()
+	return true
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		header, err := readByte(conn)
+	var accepted time.Time
+	if _, ok := s.Metrics.(HandshakeMetrics); ok {
+		accepted = time.Now()
+	}
+
+	// Bound the whole handshake, from the PROXY protocol header on.
+	var deadline time.Time
+	if s.HandshakeTimeout > 0 {
+		deadline = time.Now().Add(s.HandshakeTimeout)
+		conn.SetDeadline(deadline)
+	}
+	if s.ProxyProtocol {
+		c, err := readProxyProtocol(conn)
 		if err != nil {
-			return err
+			return s.onError(ctx, "handshake", conn, err)
 		}
-		if header != userAuthVersion {
-			return fmt.Errorf("unsupported auth version: %d", header)
+		conn = c
+	}
+	if s.ConnContext != nil {
+		if c := s.ConnContext(ctx, conn); c != nil {
+			ctx = c
 		}
-
-		username, err := readBytes(conn)
+	}
+	if s.RequestLimiter != nil && !s.RequestLimiter.Allow(conn.RemoteAddr()) {
+		return s.onError(ctx, "connect", conn, fmt.Errorf("%w: %s", ErrRequestLimited, conn.RemoteAddr()))
+	}
+	if s.OnConnect != nil {
+		c, err := s.OnConnect(ctx, conn)
 		if err != nil {
-			return err
+			return s.onError(ctx, "connect", conn, err)
 		}
-		req.Username = string(username)
-
-		password, err := readBytes(conn)
+		if c != nil && c != conn {
+			defer c.Close()
+			conn = c
+			if s.HandshakeTimeout > 0 {
+				conn.SetDeadline(deadline)
+			}
+		}
+	}
+	if s.Slog != nil {
+		s.Slog.DebugContext(ctx, "connection accepted", "conn_id", ConnID(ctx), "client", conn.RemoteAddr().String())
+	}
+	if s.Fallback != nil || s.AllowSOCKS4 {
+		version, err := readByte(conn)
 		if err != nil {
-			return err
+			return s.onError(ctx, "handshake", conn, closedBeforeNegotiation(err))
 		}
-		req.Password = string(password)
-
-		if !s.Authentication.Auth(req.Command, req.Username, req.Password) {
-			_, err := conn.Write([]byte{userAuthVersion, authFailure})
-			if err != nil {
-				return err
+		conn = &prefixConn{Conn: conn, prefix: []byte{version}}
+		if version == socks4Version && s.AllowSOCKS4 {
+			return s.serveSOCKS4(ctx, conn)
+		}
+		if version != socks5Version && s.Fallback != nil {
+			if s.HandshakeTimeout > 0 {
+				conn.SetDeadline(time.Time{})
+			}
+			if err := s.Fallback(ctx, conn); err != nil {
+				return s.onError(ctx, "fallback", conn, err)
 			}
-			return errUserAuthFailed
+			return nil
 		}
-		_, err = conn.Write([]byte{userAuthVersion, authSuccess})
+	}
+	req, err := s.handshake(ctx, conn)
+	if err != nil {
+		phase := "handshake"
+		var pe *phaseError
+		if errors.As(err, &pe) {
+			phase, err = pe.phase, pe.err
+		}
+		if isTimeoutError(err) {
+			err = fmt.Errorf("%w: %v", ErrHandshakeTimeout, err)
+		}
+		return s.onError(ctx, phase, conn, err)
+	}
+	if req.ctx != nil && req.ctx != ctx {
+		// Adopt the context returned by an AuthenticatorWithContext.
+		ctx, cancel = context.WithCancel(req.ctx)
+		defer cancel()
+	}
+	req.accepted = accepted
+	if s.AccessLog != nil {
+		defer s.logAccess(req, time.Now(), &err)
+	}
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	ctx = context.WithValue(ctx, requestContextKey{}, req)
+	req.ctx = ctx
+	req.cancel = cancel
+	if s.Rules != nil {
+		if code := allow(ctx, s.Rules, req); code != SuccessReply {
+			if err := s.sendReply(req, code, nil); err != nil {
+				return s.onError(ctx, "reply", req.Conn, err)
+			}
+			return s.onError(ctx, "rules", req.Conn, fmt.Errorf("%v to %v: %w", req.Command, req.DestinationAddr, ErrNotAllowed))
+		}
+	}
+	if s.Quota != nil && !s.Quota.Check(req.Username) {
+		if err := s.sendReply(req, RuleFailureReply, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, err)
+		}
+		return s.onError(ctx, "quota", req.Conn, fmt.Errorf("%w: %q", ErrQuotaExceeded, req.Username))
+	}
+	if s.Rewrite != nil {
+		dest, err := s.Rewrite(ctx, req)
 		if err != nil {
-			return err
+			if err := s.sendReply(req, errToReply(err), nil); err != nil {
+				return s.onError(ctx, "reply", req.Conn, err)
+			}
+			return s.onError(ctx, "rewrite", req.Conn, err)
+		}
+		if dest != nil {
+			req.DestinationAddr = dest
 		}
-	} else if s.Authentication == nil && bytes.IndexByte(methods, byte(noAuth)) != -1 {
-		_, err := conn.Write([]byte{socks5Version, byte(noAuth)})
+	}
+	if s.Metrics != nil {
+		s.Metrics.IncConnections(req.Command)
+		defer s.Metrics.DecConnections(req.Command)
+	}
+	return s.serveRequest(req)
+}
+
+func (s *Server) handshake(ctx context.Context, conn net.Conn) (*Request, error) {
+	version, err := readByte(conn)
+	if err != nil {
+		return nil, closedBeforeNegotiation(err)
+	}
+	if version != socks5Version {
+		return nil, fmt.Errorf("%w: SOCKS version %d", ErrUnsupportedVersion, version)
+	}
+
+	req := &Request{
+		Version:    socks5Version,
+		ConnID:     ConnID(ctx),
+		Conn:       conn,
+		RemoteAddr: conn.RemoteAddr(),
+	}
+
+	methods, err := readBytes(conn)
+	if err != nil {
+		return nil, closedBeforeNegotiation(err)
+	}
+
+	if s.AuthLimiter != nil && !s.AuthLimiter.Allow(req.RemoteAddr) {
+		_, err := conn.Write([]byte{socks5Version, byte(noAcceptable)})
 		if err != nil {
-			return err
+			return nil, err
 		}
-	} else {
+		return nil, &phaseError{phase: "auth", err: ErrAuthLimited}
+	}
+
+	method := s.selectAuthMethod(conn, methods)
+	if method == nil {
 		_, err := conn.Write([]byte{socks5Version, byte(noAcceptable)})
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return errNoSupportedAuth
+		s.stats.noAcceptableMethods()
+		return nil, &phaseError{phase: "auth", err: ErrNoSupportedAuth}
+	}
+	req.AuthMethod = method.Method()
+	_, err = conn.Write([]byte{socks5Version, req.AuthMethod})
+	if err != nil {
+		return nil, err
 	}
+	if m, ok := method.(contextAuthMethod); ok {
+		req.ctx, conn, req.Username, err = m.authenticateContext(ctx, conn)
+	} else {
+		conn, req.Username, err = method.Authenticate(conn)
+	}
+	if s.AuthLimiter != nil {
+		if err == nil {
+			s.AuthLimiter.Success(req.RemoteAddr)
+		} else if errors.Is(err, ErrUserAuthFailed) {
+			s.AuthLimiter.Failure(req.RemoteAddr)
+		}
+	}
+	if err != nil {
+		if s.Slog != nil {
+			s.Slog.WarnContext(ctx, "authentication failed", "conn_id", req.ConnID, "client", req.RemoteAddr.String(), "method", authMethod(method.Method()).String(), "error", err)
+		}
+		return nil, &phaseError{phase: "auth", err: err}
+	}
+	if s.Slog != nil {
+		s.Slog.DebugContext(ctx, "authenticated", "conn_id", req.ConnID, "client", req.RemoteAddr.String(), "method", authMethod(method.Method()).String(), "username", req.Username)
+	}
+	req.Conn = conn
 
 	var header [3]byte
 	_, err = io.ReadFull(conn, header[:])
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if header[0] != socks5Version {
-		return fmt.Errorf("unsupported Command version: %d", header[0])
+		return nil, fmt.Errorf("%w: Command version %d", ErrUnsupportedVersion, header[0])
 	}
 
 	req.Command = Command(header[1])
 
-	dest, err := readAddr(conn)
+	dest, err := ReadAddr(conn)
 	if err != nil {
-		if err == errUnrecognizedAddrType {
-			err := sendReply(conn, addrTypeNotSupported, nil)
+		if errors.Is(err, ErrUnrecognizedAddrType) {
+			err := sendReply(conn, AddrTypeNotSupportedReply, nil)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
-		return err
+		return nil, err
 	}
 	req.DestinationAddr = dest
-	err = s.handle(req)
-	if err != nil {
-		return err
+	if s.StrictProtocol && header[2] != 0 {
+		err := sendReply(conn, ServerFailureReply, nil)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: request reserved byte %#x", ErrProtocolViolation, header[2])
 	}
+	return req, nil
+}
 
+// selectAuthMethod returns the first of the server's authentication
+// methods that is offered by the client and accepts conn.
+func (s *Server) selectAuthMethod(conn net.Conn, offered []byte) AuthMethod {
+	methods := s.authMethods()
+	required := false
+	if s.AuthRequired != nil {
+		required = s.AuthRequired(conn)
+		if !required {
+			methods = append(methods[:len(methods):len(methods)], NoAuthMethod())
+		}
+	}
+	for _, method := range methods {
+		if bytes.IndexByte(offered, method.Method()) == -1 {
+			continue
+		}
+		if required && method.Method() == byte(noAuth) {
+			continue
+		}
+		if filter, ok := method.(AuthMethodFilter); ok && !filter.Accept(conn) {
+			continue
+		}
+		return method
+	}
 	return nil
 }
 
-func (s *Server) handle(req *request) error {
-	switch req.Command {
-	case ConnectCommand:
-		return s.handleConnect(req)
-	case BindCommand:
-		return s.handleBind(req)
-	case AssociateCommand:
-		return s.handleAssociate(req)
-	default:
-		if err := sendReply(req.Conn, commandNotSupported, nil); err != nil {
-			return err
+func (s *Server) authMethods() []AuthMethod {
+	if s.AuthMethods != nil {
+		return s.AuthMethods
+	}
+	methods := make([]AuthMethod, 0, 2)
+	if s.GSSAPIAuthenticator != nil {
+		methods = append(methods, GSSAPIAuthMethod(s.GSSAPIAuthenticator))
+	}
+	if s.Authentication != nil {
+		methods = append(methods, UserAuthMethod(s.Authentication))
+	}
+	if len(methods) == 0 {
+		methods = append(methods, NoAuthMethod())
+	}
+	return methods
+}
+
+func (s *Server) handle(req *Request) error {
+	if s.commandEnabled(req.Command) {
+		switch req.Command {
+		case ConnectCommand:
+			return s.handleConnect(req)
+		case BindCommand:
+			return s.handleBind(req)
+		case AssociateCommand:
+			return s.handleAssociate(req)
+		}
+	}
+	if err := s.sendReply(req, CommandNotSupportedReply, nil); err != nil {
+		return s.onError(req.Context(), "reply", req.Conn, err)
+	}
+	return s.onError(req.Context(), "command", req.Conn, fmt.Errorf("%w: %v", ErrUnsupportedCommand, req.Command))
+}
+
+func (s *Server) commandEnabled(cmd Command) bool {
+	if len(s.EnabledCommands) == 0 {
+		return true
+	}
+	for _, enabled := range s.EnabledCommands {
+		if enabled == cmd {
+			return true
 		}
-		return fmt.Errorf("unsupported Command: %v", req.Command)
 	}
+	return false
 }
 
-func (s *Server) handleConnect(req *request) error {
-	ctx := s.context()
-	target, err := s.proxyDial(ctx, "tcp", req.DestinationAddr.Address())
+func (s *Server) handleConnect(req *Request) error {
+	ctx := req.Context()
+	if !s.AllowUnspecifiedDestination && !validDestination(req.DestinationAddr) {
+		if err := s.sendReply(req, HostUnreachableReply, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, err)
+		}
+		return s.onError(ctx, "command", req.Conn, fmt.Errorf("%w: %v", ErrInvalidDestination, req.DestinationAddr))
+	}
+	if s.Slog != nil {
+		s.Slog.InfoContext(ctx, "dial", req.logAttrs()...)
+	}
+	dialCtx := ctx
+	if s.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, s.DialTimeout)
+		defer cancel()
+	}
+	stopWatch := watchConn(req.Conn, req.cancel)
+	target, err := s.dialDestination(dialCtx, req)
+	req.Conn = stopWatch()
 	if err != nil {
-		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		resp := errToReply(err)
+		if dialCtx.Err() == context.DeadlineExceeded {
+			resp = TTLExpiredReply
+		}
+		if err := s.sendReply(req, resp, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
 		}
-		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
+		return s.onError(ctx, "dial", req.Conn, fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
 	}
 	defer target.Close()
 
-	localAddr := target.LocalAddr()
-	local, ok := localAddr.(*net.TCPAddr)
+	localAddr := s.advertisedAddr(target.LocalAddr())
+	bind, ok := replyAddr(localAddr)
 	if !ok {
-		return fmt.Errorf("connect to %v failed: local address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String())
+		if err := s.sendReply(req, ServerFailureReply, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "dial", req.Conn, fmt.Errorf("connect to %v failed: local address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String()))
+	}
+	buf1, buf2, err := s.tunnelBuffers()
+	if err != nil {
+		if err := s.sendReply(req, ServerFailureReply, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "tunnel", req.Conn, err)
 	}
-	bind := address{IP: local.IP, Port: local.Port}
-	if err := sendReply(req.Conn, successReply, &bind); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+	defer s.putTunnelBuffers(buf1, buf2)
+	if err := s.sendReply(req, SuccessReply, bind); err != nil {
+		return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
 	}
 
-	var buf1, buf2 []byte
-	if s.BytesPool != nil {
-		buf1 = s.BytesPool.Get()
-		buf2 = s.BytesPool.Get()
-		defer func() {
-			s.BytesPool.Put(buf1)
-			s.BytesPool.Put(buf2)
-		}()
-	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
+	client := req.Conn
+	if s.InspectSNI {
+		client = s.inspectSNI(req, client)
 	}
-	return tunnel(ctx, target, req.Conn, buf1, buf2)
+	sent, received, err := s.tunnel(ctx, target, client, buf1, buf2)
+	s.tunnelClosed(req, sent, received, err)
+	if err != nil {
+		return s.onError(ctx, "tunnel", req.Conn, err)
+	}
+	return nil
 }
 
-func (s *Server) handleBind(req *request) error {
-	ctx := s.context()
+func (s *Server) handleBind(req *Request) error {
+	ctx := req.Context()
 
-	var lc net.ListenConfig
-	listener, err := lc.Listen(ctx, "tcp", req.DestinationAddr.String())
+	listenAddr := req.DestinationAddr.String()
+	var peerIP net.IP
+	if s.StrictBindPeer {
+		host := ""
+		if tcpLocal, ok := req.Conn.LocalAddr().(*net.TCPAddr); ok {
+			host = tcpLocal.IP.String()
+		}
+		listenAddr = net.JoinHostPort(host, "0")
+		ip, err := s.bindPeerIP(ctx, req.DestinationAddr)
+		if err != nil {
+			if err := s.sendReply(req, errToReply(err), nil); err != nil {
+				return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+			}
+			return s.onError(ctx, "bind", req.Conn, fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
+		}
+		peerIP = ip
+	}
+
+	listener, err := s.bindListen(ctx, "tcp", listenAddr)
 	if err != nil {
-		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		if err := s.sendReply(req, errToReply(err), nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
 		}
-		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
+		return s.onError(ctx, "bind", req.Conn, fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
 	}
+	defer listener.Close()
 
-	localAddr := listener.Addr()
-	local, ok := localAddr.(*net.TCPAddr)
+	localAddr := s.advertisedAddr(listener.Addr())
+	bind, ok := replyAddr(localAddr)
 	if !ok {
-		listener.Close()
-		return fmt.Errorf("connect to %v failed: local address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String())
+		if err := s.sendReply(req, ServerFailureReply, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "bind", req.Conn, fmt.Errorf("connect to %v failed: local address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String()))
 	}
-	bind := address{IP: local.IP, Port: local.Port}
-	if err := sendReply(req.Conn, successReply, &bind); err != nil {
-		listener.Close()
-		return fmt.Errorf("failed to send reply: %v", err)
+	buf1, buf2, err := s.tunnelBuffers()
+	if err != nil {
+		if err := s.sendReply(req, ServerFailureReply, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "tunnel", req.Conn, err)
+	}
+	defer s.putTunnelBuffers(buf1, buf2)
+	// The first reply reports the address the listener is bound to.
+	if err := s.sendReply(req, SuccessReply, bind); err != nil {
+		return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
 	}
 
-	conn, err := listener.Accept()
+	if s.BindTimeout > 0 {
+		if dl, ok := listener.(interface{ SetDeadline(time.Time) error }); ok {
+			dl.SetDeadline(time.Now().Add(s.BindTimeout))
+		}
+	}
+	conn, err := s.acceptBindPeer(ctx, listener, peerIP)
 	if err != nil {
-		listener.Close()
-		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		resp := errToReply(err)
+		if isTimeoutError(err) {
+			resp = TTLExpiredReply
+		}
+		if err := s.sendReply(req, resp, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
 		}
-		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
+		return s.onError(ctx, "bind", req.Conn, fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
 	}
+	defer conn.Close()
 	listener.Close()
 
+	// The second reply reports the address of the connecting host.
 	remoteAddr := conn.RemoteAddr()
-	local, ok = remoteAddr.(*net.TCPAddr)
+	peer, ok := remoteAddr.(*net.TCPAddr)
 	if !ok {
-		return fmt.Errorf("connect to %v failed: remote address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String())
+		if err := s.sendReply(req, ServerFailureReply, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "bind", req.Conn, fmt.Errorf("connect to %v failed: remote address is %s://%s", req.DestinationAddr, remoteAddr.Network(), remoteAddr.String()))
 	}
-	bind = address{IP: local.IP, Port: local.Port}
-	if err := sendReply(req.Conn, successReply, &bind); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+	peerAddr := Address{IP: peer.IP, Port: peer.Port}
+	if err := s.sendReply(req, SuccessReply, &peerAddr); err != nil {
+		return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
 	}
 
-	var buf1, buf2 []byte
-	if s.BytesPool != nil {
-		buf1 = s.BytesPool.Get()
-		buf2 = s.BytesPool.Get()
-		defer func() {
-			s.BytesPool.Put(buf1)
-			s.BytesPool.Put(buf2)
-		}()
-	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
+	sent, received, err := s.tunnel(ctx, conn, req.Conn, buf1, buf2)
+	s.tunnelClosed(req, sent, received, err)
+	if err != nil {
+		return s.onError(ctx, "tunnel", req.Conn, err)
 	}
-	return tunnel(ctx, conn, req.Conn, buf1, buf2)
+	return nil
 }
 
-func (s *Server) handleAssociate(req *request) error {
-	ctx := s.context()
-	destinationAddr := req.DestinationAddr.String()
+// bindPeerIP returns the IP of the peer expected by a BIND to dest,
+// or nil to accept any peer if dest has an unspecified IP.
+func (s *Server) bindPeerIP(ctx context.Context, dest *Address) (net.IP, error) {
+	if dest.Name != "" {
+		return s.resolve(ctx, dest.Name)
+	}
+	if dest.IP == nil || dest.IP.IsUnspecified() {
+		return nil, nil
+	}
+	return dest.IP, nil
+}
+
+// acceptBindPeer accepts the inbound connection of a BIND,
+// closing those not from peer if set.
+func (s *Server) acceptBindPeer(ctx context.Context, listener net.Listener, peer net.IP) (net.Conn, error) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil || peer == nil {
+			return conn, err
+		}
+		if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok && remote.IP.Equal(peer) {
+			return conn, nil
+		}
+		s.logError(ctx, fmt.Errorf("reject bind connection from %s, expected %v", conn.RemoteAddr(), peer))
+		conn.Close()
+	}
+}
+
+func (s *Server) handleAssociate(req *Request) (err error) {
+	ctx := req.Context()
+	destinationAddr := associateListenAddr(req)
 	udpConn, err := s.proxyListenPacket(ctx, "udp", destinationAddr)
 	if err != nil {
-		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		if err := s.sendReply(req, errToReply(err), nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
 		}
-		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
+		return s.onError(ctx, "associate", req.Conn, fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
 	}
 	defer udpConn.Close()
 
@@ -322,18 +1166,47 @@ func (s *Server) handleAssociate(req *request) error {
 	}
 	ip, port, err := replyPacketForwardAddress(ctx, destinationAddr, udpConn, req.Conn)
 	if err != nil {
-		return err
+		if err := s.sendReply(req, ServerFailureReply, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "associate", req.Conn, err)
+	}
+	if s.UDPAdvertisedIP != nil {
+		ip = s.UDPAdvertisedIP
+	} else if ip.IsUnspecified() {
+		if tcpLocal, ok := req.Conn.LocalAddr().(*net.TCPAddr); ok {
+			ip = tcpLocal.IP
+		}
 	}
-	bind := address{IP: ip, Port: port}
-	if err := sendReply(req.Conn, successReply, &bind); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+	bind := &Address{IP: ip, Port: port}
+	if addr, ok := replyAddr(s.advertisedAddr(&net.UDPAddr{IP: ip, Port: port})); ok {
+		bind = addr
+	}
+	if err := s.sendReply(req, SuccessReply, bind); err != nil {
+		return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
 	}
 
+	if s.OnAssociate != nil {
+		s.OnAssociate(req)
+	}
+	var counts AssociateCounts
+	defer func() {
+		s.stats.addBytes(counts.BytesSent, counts.BytesReceived)
+		req.sent, req.received = counts.BytesSent, counts.BytesReceived
+		if s.Metrics != nil {
+			s.Metrics.ObserveBytes(req.Command, counts.BytesSent, counts.BytesReceived)
+		}
+		if s.OnAssociateClose != nil {
+			s.OnAssociateClose(req, counts, err)
+		}
+	}()
+
 	go func() {
 		var buf [1]byte
 		for {
 			_, err := req.Conn.Read(buf[:])
 			if err != nil {
+				req.cancel()
 				udpConn.Close()
 				break
 			}
@@ -341,78 +1214,361 @@ func (s *Server) handleAssociate(req *request) error {
 	}()
 
 	var (
-		sourceAddr  net.Addr
-		wantSource  string
-		targetAddr  net.Addr
-		wantTarget  string
-		replyPrefix []byte
-		buf         [maxUdpPacket]byte
+		sourceAddr net.Addr
+		targets    = newUDPTargets(maxUDPTargets)
+		resolved   = newUDPNames(maxUDPNames, udpNameTTL)
+		maxSize    = s.maxUDPPacketSize()
+		// Room for a byte more than maxSize to detect truncated
+		// datagrams, and for the header prepended to replies.
+		buf         = make([]byte, maxSize+1+maxUDPHeaderLen)
+		reassembler = udpReassembler{maxAge: s.MaxUDPFragmentAge}
 	)
 
 	for {
-		n, addr, err := udpConn.ReadFrom(buf[:])
+		if s.UDPTimeout > 0 {
+			udpConn.SetReadDeadline(time.Now().Add(s.UDPTimeout))
+		}
+		n, addr, err := udpConn.ReadFrom(buf[:maxSize+1])
 		if err != nil {
-			return err
+			if isTimeoutError(err) {
+				return s.onError(ctx, "associate", req.Conn, fmt.Errorf("associate %v idle timeout: %w", req.DestinationAddr, err))
+			}
+			return s.onError(ctx, "associate", req.Conn, err)
+		}
+		if n > maxSize {
+			s.stats.udpPacketTooLarge()
+			s.logError(ctx, fmt.Errorf("drop datagram from %s larger than %d bytes", addr, maxSize))
+			continue
 		}
 
 		if sourceAddr == nil {
+			if s.StrictUDPSource && !allowedUDPSource(req, addr) {
+				s.logError(ctx, fmt.Errorf("ignore datagram from %s not from client %s", addr, req.RemoteAddr))
+				continue
+			}
 			sourceAddr = addr
-			wantSource = sourceAddr.String()
 		}
 
-		gotAddr := addr.String()
-		if wantSource == gotAddr {
+		if udpAddrEqual(sourceAddr, addr) {
 			if n < 3 {
 				continue
 			}
+			if s.StrictProtocol && (buf[0] != 0 || buf[1] != 0) {
+				s.logError(ctx, fmt.Errorf("drop datagram from %s: %w: reserved bytes %#x", sourceAddr, ErrProtocolViolation, buf[:2]))
+				continue
+			}
 			reader := bytes.NewBuffer(buf[3:n])
-			addr, err := readAddr(reader)
+			dest, err := ReadAddr(reader)
 			if err != nil {
-				if s.Logger != nil {
-					s.Logger.Println(err)
+				s.logError(ctx, err)
+				continue
+			}
+			now := time.Now()
+			ip := dest.IP
+			if dest.Name != "" {
+				ip = resolved.get(dest.Name, now)
+				if ip == nil {
+					ip, err = s.resolve(ctx, dest.Name)
+					if err != nil {
+						s.logError(ctx, err)
+						continue
+					}
+					resolved.add(dest.Name, ip, now)
 				}
+			}
+			if !s.allowedIP(ip) || !s.allowedPort(dest.Port) {
+				s.logError(ctx, fmt.Errorf("drop datagram to %v: %w", dest, ErrNotAllowed))
 				continue
 			}
-			if targetAddr == nil {
-				targetAddr = &net.UDPAddr{
-					IP:   addr.IP,
-					Port: addr.Port,
+			key := newUDPAddrKey(ip, dest.Port, "")
+			target, ok := targets.get(key, now)
+			if !ok {
+				target, err = newUDPTarget(ip, dest.Port)
+				if err != nil {
+					s.logError(ctx, fmt.Errorf("drop datagram to %v: %w", dest, err))
+					continue
 				}
-				wantTarget = targetAddr.String()
+				targets.add(key, target, now)
 			}
-			if addr.String() != wantTarget {
-				if s.Logger != nil {
-					s.Logger.Println(fmt.Errorf("ignore non-target addresses %s", addr))
+
+			data := reader.Bytes()
+			if frag := buf[2]; frag != 0 {
+				if s.MaxUDPFragmentAge <= 0 {
+					s.logError(ctx, fmt.Errorf("drop fragmented datagram %d from %s", frag, sourceAddr))
+					continue
+				}
+				data = reassembler.add(frag, data)
+				if data == nil {
+					continue
 				}
+			}
+			if s.OnUDPDatagram != nil && !s.OnUDPDatagram(ctx, sourceAddr, dest, data) {
 				continue
 			}
-			_, err = udpConn.WriteTo(reader.Bytes(), targetAddr)
+			_, err = udpConn.WriteTo(data, target.addr)
 			if err != nil {
 				return err
 			}
-		} else if targetAddr != nil && wantTarget == gotAddr {
-			if replyPrefix == nil {
-				b := bytes.NewBuffer(make([]byte, 3, 16))
-				err = writeAddrWithStr(b, wantTarget)
-				if err != nil {
-					return err
+			counts.PacketsSent++
+			counts.BytesSent += int64(len(data))
+			if s.Quota != nil {
+				s.Quota.Add(req.Username, int64(len(data)), 0)
+				if !s.Quota.Check(req.Username) {
+					return s.onError(ctx, "quota", req.Conn, fmt.Errorf("%w: %q", ErrQuotaExceeded, req.Username))
 				}
-				replyPrefix = b.Bytes()
 			}
-			copy(buf[len(replyPrefix):len(replyPrefix)+n], buf[:n])
-			copy(buf[:len(replyPrefix)], replyPrefix)
-			_, err = udpConn.WriteTo(buf[:len(replyPrefix)+n], sourceAddr)
+		} else if target, ok := targets.get(udpAddrKeyOf(addr), time.Now()); ok {
+			prefix := target.prefix
+			copy(buf[len(prefix):len(prefix)+n], buf[:n])
+			copy(buf[:len(prefix)], prefix)
+			_, err = udpConn.WriteTo(buf[:len(prefix)+n], sourceAddr)
 			if err != nil {
 				return err
 			}
+			counts.PacketsReceived++
+			counts.BytesReceived += int64(n)
+			if s.Quota != nil {
+				s.Quota.Add(req.Username, 0, int64(n))
+				if !s.Quota.Check(req.Username) {
+					return s.onError(ctx, "quota", req.Conn, fmt.Errorf("%w: %q", ErrQuotaExceeded, req.Username))
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) maxUDPPacketSize() int {
+	if s.MaxUDPPacketSize <= 0 {
+		return maxUdpPacket
+	}
+	return s.MaxUDPPacketSize
+}
+
+// tunnelBuffers returns the buffers of a tunnel, to be passed to tunnel,
+// before success is replied so that a failing BytesPool is reported.
+func (s *Server) tunnelBuffers() (buf1, buf2 []byte, err error) {
+	if s.Tunnel != nil {
+		return nil, nil, nil
+	}
+	buf1, err = s.getBuffer()
+	if err != nil {
+		return nil, nil, err
+	}
+	buf2, err = s.getBuffer()
+	if err != nil {
+		s.putBuffer(buf1)
+		return nil, nil, err
+	}
+	return buf1, buf2, nil
+}
+
+func (s *Server) putTunnelBuffers(buf1, buf2 []byte) {
+	if buf1 != nil {
+		s.putBuffer(buf1)
+		s.putBuffer(buf2)
+	}
+}
+
+func (s *Server) tunnel(ctx context.Context, c1, c2 net.Conn, buf1, buf2 []byte) (int64, int64, error) {
+	if s.KeepAlivePeriod > 0 {
+		setKeepAlive(c1, s.KeepAlivePeriod)
+		setKeepAlive(c2, s.KeepAlivePeriod)
+	}
+	if s.DisableNoDelay {
+		setNoDelay(c1, false)
+		setNoDelay(c2, false)
+	}
+	c1, c2 = s.wrapTunnel(ctx, c1, c2)
+	if s.Tunnel != nil {
+		client := &countingConn{Conn: c2}
+		err := s.Tunnel(ctx, c1, client)
+		return atomic.LoadInt64(&client.read), atomic.LoadInt64(&client.written), err
+	}
+	return drainTunnel(ctx, c1, c2, buf1, buf2, s.DrainTimeout)
+}
+
+// wrapTunnel wraps the destination c1 and the client c2 of a tunnel
+// with the Quota, IdleTimeout and RateLimit if set.
+func (s *Server) wrapTunnel(ctx context.Context, c1, c2 net.Conn) (net.Conn, net.Conn) {
+	if s.Quota != nil {
+		if req, ok := RequestFromContext(ctx); ok {
+			c2 = &quotaConn{Conn: c2, quota: s.Quota, user: req.Username}
+		}
+	}
+	if s.IdleTimeout > 0 {
+		c1, c2 = withIdleTimeout(c1, c2, s.IdleTimeout)
+	}
+	if s.RateLimit != nil {
+		c1, c2 = s.RateLimit.wrap(ctx, c1, c2)
+	}
+	return c1, c2
+}
+
+func (s *Server) getBuffer() ([]byte, error) {
+	if s.BytesPool != nil {
+		buf := s.BytesPool.Get()
+		if len(buf) == 0 {
+			return nil, errEmptyBuffer
+		}
+		return buf, nil
+	}
+	size := s.BufferSize
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	return make([]byte, size), nil
+}
+
+func (s *Server) putBuffer(buf []byte) {
+	if s.BytesPool != nil {
+		s.BytesPool.Put(buf)
+	}
+}
+
+// advertisedAddr returns the address to send in a success reply for local.
+func (s *Server) advertisedAddr(local net.Addr) net.Addr {
+	if s.AdvertisedAddr == nil {
+		return local
+	}
+	return s.AdvertisedAddr(local)
+}
+
+// logError logs err to Logger if set, prefixed with the connection ID.
+func (s *Server) logError(ctx context.Context, err error) {
+	if s.Logger == nil {
+		return
+	}
+	if id := ConnID(ctx); id != "" {
+		err = fmt.Errorf("conn %s: %w", id, err)
+	}
+	s.Logger.Println(err)
+}
+
+// onError reports err in phase to OnError if set, and returns err.
+func (s *Server) onError(ctx context.Context, phase string, conn net.Conn, err error) error {
+	if isClosedConnError(err) {
+		return err
+	}
+	if s.Slog != nil {
+		s.Slog.ErrorContext(ctx, "connection failed", "conn_id", ConnID(ctx), "client", conn.RemoteAddr().String(), "phase", phase, "error", err)
+	}
+	if s.OnError != nil {
+		s.OnError(ctx, phase, conn, err)
+	}
+	return err
+}
+
+// phaseError is an error annotated with the phase it occurred in.
+type phaseError struct {
+	phase string
+	err   error
+}
+
+func (e *phaseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *phaseError) Unwrap() error {
+	return e.err
+}
+
+func (s *Server) tunnelClosed(req *Request, sent, received int64, err error) {
+	s.stats.addBytes(sent, received)
+	req.sent, req.received = sent, received
+	if s.Metrics != nil {
+		s.Metrics.ObserveBytes(req.Command, sent, received)
+	}
+	if s.Slog != nil {
+		s.Slog.InfoContext(req.Context(), "tunnel closed", append(req.logAttrs(), "sent", sent, "received", received)...)
+	}
+	if s.OnConnClose != nil {
+		s.OnConnClose(req, sent, received, err)
+	}
+}
+
+// validDestination reports whether addr can be dialed.
+func validDestination(addr *Address) bool {
+	if addr.Port == 0 {
+		return false
+	}
+	if addr.Name == "" && (addr.IP == nil || addr.IP.IsUnspecified()) {
+		return false
+	}
+	return true
+}
+
+// dialDestination dials the destination of req with the dialer
+// selected by the Router, retrying transient failures up to
+// DialRetries times.
+func (s *Server) dialDestination(ctx context.Context, req *Request) (net.Conn, error) {
+	dial := s.proxyDial
+	passThrough := s.PassThroughNames && s.ProxyDial != nil
+	if s.Router != nil {
+		if d := s.Router.SelectDialer(ctx, req); d != nil {
+			dial = d
+			passThrough = s.PassThroughNames
+		}
+	}
+	for retries := 0; ; retries++ {
+		conn, err := s.dialDestinationOnce(ctx, dial, req.DestinationAddr, passThrough)
+		if err == nil || retries >= s.DialRetries || !isTransientError(err) || ctx.Err() != nil {
+			return conn, err
+		}
+		if s.DialRetryBackoff > 0 {
+			timer := time.NewTimer(s.DialRetryBackoff << retries)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, err
+			}
 		}
 	}
 }
 
+// dialDestinationOnce dials dest with dial, resolving its name with
+// the Resolver if set, unless passThrough.
+func (s *Server) dialDestinationOnce(ctx context.Context, dial ProxyDialFunc, dest *Address, passThrough bool) (net.Conn, error) {
+	if !s.allowedPort(dest.Port) {
+		return nil, fmt.Errorf("%w: port %d", ErrNotAllowed, dest.Port)
+	}
+	address := dest.Address()
+	ip := dest.IP
+	if dest.Name != "" && (s.Resolver != nil || s.filtersNetworks()) && !passThrough {
+		var err error
+		ip, err = s.resolve(ctx, dest.Name)
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(ip.String(), strconv.Itoa(dest.Port))
+	}
+	if ip != nil && !s.allowedIP(ip) {
+		return nil, fmt.Errorf("%w: %v", ErrNotAllowed, ip)
+	}
+	return dial(ctx, "tcp", address)
+}
+
+func (s *Server) resolve(ctx context.Context, name string) (net.IP, error) {
+	if s.Resolver != nil {
+		return s.Resolver.Resolve(ctx, name)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", name)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
 func (s *Server) proxyDial(ctx context.Context, network, address string) (net.Conn, error) {
 	proxyDial := s.ProxyDial
 	if proxyDial == nil {
-		var dialer net.Dialer
+		dialer := net.Dialer{
+			FallbackDelay: s.FallbackDelay,
+		}
+		if s.LocalIP != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: s.LocalIP}
+		}
+		dialer.Control = s.Control
 		proxyDial = dialer.DialContext
 	}
 	return proxyDial(ctx, network, address)
@@ -421,12 +1577,66 @@ func (s *Server) proxyDial(ctx context.Context, network, address string) (net.Co
 func (s *Server) proxyListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
 	proxyListenPacket := s.ProxyListenPacket
 	if proxyListenPacket == nil {
-		var listener net.ListenConfig
+		listener := net.ListenConfig{
+			Control: s.Control,
+		}
 		proxyListenPacket = listener.ListenPacket
+		if s.LocalIP != nil {
+			_, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			address = net.JoinHostPort(s.LocalIP.String(), port)
+		}
+		if s.UDPPortRange != [2]int{} {
+			return s.listenPacketInRange(ctx, proxyListenPacket, network, address)
+		}
 	}
 	return proxyListenPacket(ctx, network, address)
 }
 
+// bindListen listens for the peer of a BIND request on address,
+// on the LocalIP instead of its host if set.
+func (s *Server) bindListen(ctx context.Context, network, address string) (net.Listener, error) {
+	listener := net.ListenConfig{
+		Control: s.Control,
+	}
+	if s.LocalIP != nil {
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(s.LocalIP.String(), port)
+	}
+	return listener.Listen(ctx, network, address)
+}
+
+// listenPacketInRange listens on the host of address with the first free
+// port of the UDPPortRange, starting from a random one.
+func (s *Server) listenPacketInRange(ctx context.Context, listenPacket func(ctx context.Context, network, address string) (net.PacketConn, error), network, address string) (net.PacketConn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	first, last := s.UDPPortRange[0], s.UDPPortRange[1]
+	if first <= 0 || last > 65535 || first > last {
+		return nil, fmt.Errorf("%w: %d-%d", errInvalidPortRange, first, last)
+	}
+	n := last - first + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := first + (start+i)%n
+		conn, err := listenPacket(ctx, network, net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: %d-%d", errNoFreePort, first, last)
+}
+
 func (s *Server) context() context.Context {
 	if s.Context == nil {
 		return context.Background()
@@ -434,35 +1644,229 @@ func (s *Server) context() context.Context {
 	return s.Context
 }
 
-func sendReply(w io.Writer, resp reply, addr *address) error {
-	_, err := w.Write([]byte{socks5Version, byte(resp), 0})
+// sendReply sends a reply to the client of req, within the
+// HandshakeTimeout if set. The first reply ends the handshake
+// observed by HandshakeMetrics.
+func (s *Server) sendReply(req *Request, resp Reply, addr *Address) error {
+	err := s.withWriteDeadline(req.Conn, func() error {
+		return sendReply(req.Conn, resp, addr)
+	})
+	if !req.accepted.IsZero() {
+		if m, ok := s.Metrics.(HandshakeMetrics); ok {
+			m.ObserveHandshakeDuration(time.Since(req.accepted), req.AuthMethod != byte(noAuth))
+		}
+		req.accepted = time.Time{}
+	}
+	return err
+}
+
+// withWriteDeadline calls write with the write deadline of conn set to
+// the HandshakeTimeout if set, so that a client not reading replies
+// cannot block the server, and clears it afterwards.
+func (s *Server) withWriteDeadline(conn net.Conn, write func() error) error {
+	if s.HandshakeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.HandshakeTimeout))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	return write()
+}
+
+// sendReply writes a reply with addr to w at once, or nothing
+// if addr cannot be written.
+func sendReply(w io.Writer, resp Reply, addr *Address) error {
+	var buf bytes.Buffer
+	buf.Write([]byte{socks5Version, byte(resp), 0})
+	err := WriteAddr(&buf, addr)
 	if err != nil {
 		return err
 	}
-	err = writeAddr(w, addr)
+	_, err = w.Write(buf.Bytes())
 	return err
 }
 
-type request struct {
-	Version         uint8
-	Command         Command
-	DestinationAddr *address
-	Username        string
-	Password        string
-	Conn            net.Conn
+// replyAddr returns the address of a reply for addr, which is
+// a *net.TCPAddr, a *net.UDPAddr or an *Address with an IP or
+// a domain name short enough to be sent.
+func replyAddr(addr net.Addr) (*Address, bool) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return &Address{IP: addr.IP, Port: addr.Port}, true
+	case *net.UDPAddr:
+		return &Address{IP: addr.IP, Port: addr.Port}, true
+	case *Address:
+		if addr.Name == "" && addr.IP == nil || len(addr.Name) > 255 {
+			return nil, false
+		}
+		return addr, true
+	default:
+		return nil, false
+	}
+}
+
+// Request is a SOCKS request received by the Server
+type Request struct {
+	// Version is the SOCKS protocol version
+	Version uint8
+	// Command is the requested SOCKS command
+	Command Command
+	// DestinationAddr is the requested destination address
+	DestinationAddr *Address
+	// AuthMethod is the negotiated authentication method,
+	// such as 0x00 for no authentication or 0x02 for username/password
+	AuthMethod byte
+	// Username is the authenticated username, if any
+	Username string
+	// Conn is the client connection
+	Conn net.Conn
+	// RemoteAddr is the client's address
+	RemoteAddr net.Addr
+	// ConnID identifies the client connection in logs, see ConnID
+	ConnID string
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	handled  bool
+	sent     int64
+	received int64
+	// accepted is when the connection was accepted, until the
+	// handshake is observed by HandshakeMetrics.
+	accepted time.Time
+}
+
+// requestContextKey is the context key of the Request being served.
+type requestContextKey struct{}
+
+// RequestFromContext returns the Request being served with ctx, such as
+// in ProxyDial to pick an egress identity from the Username
+func RequestFromContext(ctx context.Context) (*Request, bool) {
+	req, ok := ctx.Value(requestContextKey{}).(*Request)
+	return req, ok
+}
+
+// UserFromContext returns the authenticated username of the request
+// being served with ctx. It is empty and false for connections
+// without authentication
+func UserFromContext(ctx context.Context) (string, bool) {
+	req, ok := RequestFromContext(ctx)
+	if !ok || req.Username == "" {
+		return "", false
+	}
+	return req.Username, true
+}
+
+// connIDs is the last connection ID generated.
+var connIDs uint64
+
+// connIDContextKey is the context key of the connection ID.
+type connIDContextKey struct{}
+
+// withConnID returns ctx with a new connection ID, unless it has one.
+func withConnID(ctx context.Context) context.Context {
+	if ConnID(ctx) != "" {
+		return ctx
+	}
+	id := strconv.FormatUint(atomic.AddUint64(&connIDs, 1), 10)
+	return context.WithValue(ctx, connIDContextKey{}, id)
+}
+
+// ConnID returns the ID of the client connection served with ctx,
+// unique within the process and included in logs as conn_id,
+// to correlate the events of a session in hooks
+func ConnID(ctx context.Context) string {
+	id, _ := ctx.Value(connIDContextKey{}).(string)
+	return id
+}
+
+// Context returns the request's context,
+// which is canceled once the client connection is done
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// logAttrs returns the attributes identifying req in structured logs.
+func (r *Request) logAttrs() []interface{} {
+	return []interface{}{
+		"conn_id", r.ConnID,
+		"client", r.RemoteAddr.String(),
+		"command", r.Command.String(),
+		"auth_method", authMethod(r.AuthMethod).String(),
+		"destination", r.DestinationAddr.String(),
+	}
+}
+
+// allowedUDPSource reports whether addr may be the source of datagrams
+// for the association requested by req.
+func allowedUDPSource(req *Request, addr net.Addr) bool {
+	client, ok := req.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	source, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	if !client.IP.Equal(source.IP) {
+		return false
+	}
+	return req.DestinationAddr.Port == 0 || req.DestinationAddr.Port == source.Port
+}
+
+// associateListenAddr returns the address to listen on for the
+// association requested by req: the requested address if it is an IP
+// of the family of the control connection, which clients will send
+// datagrams with, or else the unspecified address of that family.
+func associateListenAddr(req *Request) string {
+	port := strconv.Itoa(req.DestinationAddr.Port)
+	local, ok := req.Conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return req.DestinationAddr.String()
+	}
+	ip := req.DestinationAddr.IP
+	if ip != nil && (ip.To4() != nil) == (local.IP.To4() != nil) {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	if local.IP.To4() != nil {
+		return net.JoinHostPort(net.IPv4zero.String(), port)
+	}
+	return net.JoinHostPort(net.IPv6unspecified.String(), port)
 }
 
 func defaultReplyPacketForwardAddress(ctx context.Context, destinationAddr string, packet net.PacketConn, conn net.Conn) (net.IP, int, error) {
 	udpLocal := packet.LocalAddr()
-	udpLocalAddr, ok := udpLocal.(*net.UDPAddr)
+	_, port, ok := splitAddr(udpLocal)
 	if !ok {
 		return nil, 0, fmt.Errorf("connect to %v failed: local address is %s://%s", destinationAddr, udpLocal.Network(), udpLocal.String())
 	}
 
 	tcpLocal := conn.LocalAddr()
-	tcpLocalAddr, ok := tcpLocal.(*net.TCPAddr)
+	ip, _, ok := splitAddr(tcpLocal)
 	if !ok {
 		return nil, 0, fmt.Errorf("connect to %v failed: local address is %s://%s", destinationAddr, tcpLocal.Network(), tcpLocal.String())
 	}
-	return tcpLocalAddr.IP, udpLocalAddr.Port, nil
+	return ip, port, nil
+}
+
+// splitAddr returns the IP and port of addr, parsing its string form
+// if it is neither a *net.UDPAddr nor a *net.TCPAddr, such as for the
+// addresses of custom packet connections.
+func splitAddr(addr net.Addr) (net.IP, int, bool) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP, addr.Port, true
+	case *net.TCPAddr:
+		return addr.IP, addr.Port, true
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, 0, false
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, 0, false
+	}
+	return ip, int(p), true
 }
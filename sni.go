@@ -0,0 +1,213 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	tlsRecordHeaderLen   = 5
+	tlsMaxRecordLen      = 16384
+	tlsHandshakeRecord   = 0x16
+	tlsClientHello       = 0x01
+	tlsServerNameExt     = 0x0000
+	tlsHostNameIndicator = 0x00
+)
+
+// inspectSNI returns conn, reporting the server name of the TLS
+// ClientHello the client sends first, if any, before it is read.
+func (s *Server) inspectSNI(req *Request, conn net.Conn) net.Conn {
+	return &sniConn{
+		Conn: conn,
+		inspect: func(name string) error {
+			if s.Slog != nil {
+				s.Slog.DebugContext(req.Context(), "tls server name", append(req.logAttrs(), "server_name", name)...)
+			}
+			if s.OnSNI != nil && !s.OnSNI(req, name) {
+				return fmt.Errorf("server name %q: %w", name, ErrNotAllowed)
+			}
+			return nil
+		},
+	}
+}
+
+// sniConn is a net.Conn that buffers the first TLS record read from Conn,
+// passes the server name of the ClientHello it holds to inspect,
+// and then returns the record as read.
+type sniConn struct {
+	net.Conn
+	inspect   func(name string) error
+	inspected bool
+	pending   []byte
+}
+
+// NetConn returns the underlying connection.
+func (c *sniConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Read implements the net.Conn Read method.
+func (c *sniConn) Read(b []byte) (int, error) {
+	if !c.inspected {
+		c.inspected = true
+		record, err := readTLSRecord(c.Conn)
+		if len(record) == 0 {
+			return 0, err
+		}
+		if name, ok := parseSNI(record); ok {
+			if err := c.inspect(name); err != nil {
+				return 0, err
+			}
+		}
+		// A read error is returned again by the next Read of Conn.
+		c.pending = record
+	}
+	if len(c.pending) != 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// readTLSRecord reads what a client sends first, and the rest of the
+// TLS handshake record it starts if any, so that other protocols
+// are not waited on for more bytes than they sent.
+func readTLSRecord(r io.Reader) ([]byte, error) {
+	buf := make([]byte, tlsRecordHeaderLen+tlsMaxRecordLen)
+	n, err := r.Read(buf)
+	if err != nil || buf[0] != tlsHandshakeRecord {
+		return buf[:n], err
+	}
+	if n < tlsRecordHeaderLen {
+		m, err := io.ReadFull(r, buf[n:tlsRecordHeaderLen])
+		n += m
+		if err != nil {
+			return buf[:n], err
+		}
+	}
+	size := tlsRecordHeaderLen + int(binary.BigEndian.Uint16(buf[3:5]))
+	if size > len(buf) {
+		return buf[:n], nil
+	}
+	if n < size {
+		m, err := io.ReadFull(r, buf[n:size])
+		n += m
+		if err != nil {
+			return buf[:n], err
+		}
+	}
+	return buf[:n], nil
+}
+
+// parseSNI returns the server name of the ClientHello in a TLS record.
+func parseSNI(record []byte) (string, bool) {
+	s := tlsBytes(record)
+	var typ uint8
+	var body tlsBytes
+	if !s.readUint8(&typ) || typ != tlsHandshakeRecord ||
+		!s.skip(2) || !s.readUint16Bytes(&body) {
+		return "", false
+	}
+	s = body
+	var hello tlsBytes
+	if !s.readUint8(&typ) || typ != tlsClientHello ||
+		!s.readUint24Bytes(&hello) {
+		return "", false
+	}
+
+	var sessionID, cipherSuites, compression, extensions tlsBytes
+	// Skip the version and random.
+	if !hello.skip(2+32) ||
+		!hello.readUint8Bytes(&sessionID) ||
+		!hello.readUint16Bytes(&cipherSuites) ||
+		!hello.readUint8Bytes(&compression) ||
+		!hello.readUint16Bytes(&extensions) {
+		return "", false
+	}
+	for len(extensions) != 0 {
+		var extType uint16
+		var ext tlsBytes
+		if !extensions.readUint16(&extType) || !extensions.readUint16Bytes(&ext) {
+			return "", false
+		}
+		if extType != tlsServerNameExt {
+			continue
+		}
+		var names tlsBytes
+		if !ext.readUint16Bytes(&names) {
+			return "", false
+		}
+		for len(names) != 0 {
+			var nameType uint8
+			var name tlsBytes
+			if !names.readUint8(&nameType) || !names.readUint16Bytes(&name) {
+				return "", false
+			}
+			if nameType == tlsHostNameIndicator && len(name) != 0 {
+				return string(name), true
+			}
+		}
+		return "", false
+	}
+	return "", false
+}
+
+// tlsBytes is a TLS message being parsed.
+type tlsBytes []byte
+
+func (s *tlsBytes) skip(n int) bool {
+	if len(*s) < n {
+		return false
+	}
+	*s = (*s)[n:]
+	return true
+}
+
+func (s *tlsBytes) readUint8(out *uint8) bool {
+	if len(*s) < 1 {
+		return false
+	}
+	*out = (*s)[0]
+	*s = (*s)[1:]
+	return true
+}
+
+func (s *tlsBytes) readUint16(out *uint16) bool {
+	if len(*s) < 2 {
+		return false
+	}
+	*out = binary.BigEndian.Uint16(*s)
+	*s = (*s)[2:]
+	return true
+}
+
+func (s *tlsBytes) readBytes(n int, out *tlsBytes) bool {
+	if len(*s) < n {
+		return false
+	}
+	*out = (*s)[:n]
+	*s = (*s)[n:]
+	return true
+}
+
+func (s *tlsBytes) readUint8Bytes(out *tlsBytes) bool {
+	var n uint8
+	return s.readUint8(&n) && s.readBytes(int(n), out)
+}
+
+func (s *tlsBytes) readUint16Bytes(out *tlsBytes) bool {
+	var n uint16
+	return s.readUint16(&n) && s.readBytes(int(n), out)
+}
+
+func (s *tlsBytes) readUint24Bytes(out *tlsBytes) bool {
+	if len(*s) < 3 {
+		return false
+	}
+	n := int((*s)[0])<<16 | int((*s)[1])<<8 | int((*s)[2])
+	*s = (*s)[3:]
+	return s.readBytes(n, out)
+}
@@ -0,0 +1,338 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	socks4Version = 0x04
+	// socks4ReplyVersion is the version of SOCKS4 replies
+	socks4ReplyVersion = 0x00
+)
+
+const (
+	socks4Granted  = 90
+	socks4Rejected = 91
+)
+
+// socks4MaxString is the maximum length of the user ID
+// and of the SOCKS4a hostname.
+const socks4MaxString = 255
+
+// serveSOCKS4 serves a SOCKS4 or SOCKS4a CONNECT or BIND request on conn,
+// whose version byte has not been read yet.
+func (s *Server) serveSOCKS4(ctx context.Context, conn net.Conn) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := readSOCKS4Request(conn)
+	if err != nil {
+		return s.onError(ctx, "handshake", conn, err)
+	}
+	if s.AccessLog != nil {
+		defer s.logAccess(req, time.Now(), &err)
+	}
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	req.ConnID = ConnID(ctx)
+	ctx = context.WithValue(ctx, requestContextKey{}, req)
+	req.ctx = ctx
+	req.cancel = cancel
+
+	if !s.socks4NoAuth(conn) {
+		if err := s.sendSOCKS4Reply(conn, socks4Rejected, nil); err != nil {
+			return s.onError(ctx, "reply", conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "auth", conn, ErrNoSupportedAuth)
+	}
+	if s.Rules != nil && allow(ctx, s.Rules, req) != SuccessReply {
+		if err := s.sendSOCKS4Reply(conn, socks4Rejected, nil); err != nil {
+			return s.onError(ctx, "reply", conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "rules", conn, fmt.Errorf("%v to %v: %w", req.Command, req.DestinationAddr, ErrNotAllowed))
+	}
+	if s.Quota != nil && !s.Quota.Check(req.Username) {
+		if err := s.sendSOCKS4Reply(conn, socks4Rejected, nil); err != nil {
+			return s.onError(ctx, "reply", conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "quota", conn, fmt.Errorf("%w: %q", ErrQuotaExceeded, req.Username))
+	}
+	if s.Rewrite != nil {
+		dest, err := s.Rewrite(ctx, req)
+		if err != nil {
+			if err := s.sendSOCKS4Reply(conn, socks4Rejected, nil); err != nil {
+				return s.onError(ctx, "reply", conn, fmt.Errorf("failed to send reply: %v", err))
+			}
+			return s.onError(ctx, "rewrite", conn, err)
+		}
+		if dest != nil {
+			req.DestinationAddr = dest
+		}
+	}
+	if s.Metrics != nil {
+		s.Metrics.IncConnections(req.Command)
+		defer s.Metrics.DecConnections(req.Command)
+	}
+	return s.serveRequest(req)
+}
+
+func (s *Server) handleSOCKS4(req *Request) error {
+	switch {
+	case req.Command == ConnectCommand && s.commandEnabled(req.Command):
+		return s.handleSOCKS4Connect(req)
+	case req.Command == BindCommand && s.commandEnabled(req.Command):
+		return s.handleSOCKS4Bind(req)
+	default:
+		if err := s.sendSOCKS4Reply(req.Conn, socks4Rejected, nil); err != nil {
+			return s.onError(req.Context(), "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(req.Context(), "command", req.Conn, fmt.Errorf("%w: %v", ErrUnsupportedCommand, req.Command))
+	}
+}
+
+// socks4NoAuth reports whether conn may be served without
+// authentication, as SOCKS4 has none.
+func (s *Server) socks4NoAuth(conn net.Conn) bool {
+	if s.AuthRequired != nil {
+		return !s.AuthRequired(conn)
+	}
+	for _, method := range s.authMethods() {
+		if method.Method() == byte(noAuth) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleSOCKS4Connect(req *Request) error {
+	ctx := req.Context()
+	if !s.AllowUnspecifiedDestination && !validDestination(req.DestinationAddr) {
+		if err := s.sendSOCKS4Reply(req.Conn, socks4Rejected, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "command", req.Conn, fmt.Errorf("%w: %v", ErrInvalidDestination, req.DestinationAddr))
+	}
+	dialCtx := ctx
+	if s.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, s.DialTimeout)
+		defer cancel()
+	}
+	stopWatch := watchConn(req.Conn, req.cancel)
+	target, err := s.dialDestination(dialCtx, req)
+	req.Conn = stopWatch()
+	if err != nil {
+		if err := s.sendSOCKS4Reply(req.Conn, socks4Rejected, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "dial", req.Conn, fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
+	}
+	defer target.Close()
+
+	localAddr := s.advertisedAddr(target.LocalAddr())
+	local, ok := socks4ReplyAddr(localAddr)
+	if !ok {
+		if err := s.sendSOCKS4Reply(req.Conn, socks4Rejected, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "dial", req.Conn, fmt.Errorf("connect to %v failed: local address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String()))
+	}
+	buf1, buf2, err := s.tunnelBuffers()
+	if err != nil {
+		if err := s.sendSOCKS4Reply(req.Conn, socks4Rejected, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "tunnel", req.Conn, err)
+	}
+	defer s.putTunnelBuffers(buf1, buf2)
+	if err := s.sendSOCKS4Reply(req.Conn, socks4Granted, local); err != nil {
+		return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+	}
+
+	client := req.Conn
+	if s.InspectSNI {
+		client = s.inspectSNI(req, client)
+	}
+	sent, received, err := s.tunnel(ctx, target, client, buf1, buf2)
+	s.tunnelClosed(req, sent, received, err)
+	if err != nil {
+		return s.onError(ctx, "tunnel", req.Conn, err)
+	}
+	return nil
+}
+
+func (s *Server) handleSOCKS4Bind(req *Request) error {
+	ctx := req.Context()
+
+	var peerIP net.IP
+	if s.StrictBindPeer {
+		ip, err := s.bindPeerIP(ctx, req.DestinationAddr)
+		if err != nil {
+			if err := s.sendSOCKS4Reply(req.Conn, socks4Rejected, nil); err != nil {
+				return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+			}
+			return s.onError(ctx, "bind", req.Conn, fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
+		}
+		peerIP = ip
+	}
+
+	host := ""
+	if tcpLocal, ok := req.Conn.LocalAddr().(*net.TCPAddr); ok && tcpLocal.IP.To4() != nil {
+		host = tcpLocal.IP.String()
+	}
+	listener, err := s.bindListen(ctx, "tcp4", net.JoinHostPort(host, "0"))
+	if err != nil {
+		if err := s.sendSOCKS4Reply(req.Conn, socks4Rejected, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "bind", req.Conn, fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
+	}
+	defer listener.Close()
+
+	localAddr := s.advertisedAddr(listener.Addr())
+	local, ok := socks4ReplyAddr(localAddr)
+	if !ok {
+		if err := s.sendSOCKS4Reply(req.Conn, socks4Rejected, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "bind", req.Conn, fmt.Errorf("connect to %v failed: local address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String()))
+	}
+	buf1, buf2, err := s.tunnelBuffers()
+	if err != nil {
+		if err := s.sendSOCKS4Reply(req.Conn, socks4Rejected, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "tunnel", req.Conn, err)
+	}
+	defer s.putTunnelBuffers(buf1, buf2)
+	if err := s.sendSOCKS4Reply(req.Conn, socks4Granted, local); err != nil {
+		return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+	}
+
+	if s.BindTimeout > 0 {
+		if dl, ok := listener.(interface{ SetDeadline(time.Time) error }); ok {
+			dl.SetDeadline(time.Now().Add(s.BindTimeout))
+		}
+	}
+	conn, err := s.acceptBindPeer(ctx, listener, peerIP)
+	if err != nil {
+		if err := s.sendSOCKS4Reply(req.Conn, socks4Rejected, nil); err != nil {
+			return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return s.onError(ctx, "bind", req.Conn, fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
+	}
+	defer conn.Close()
+	listener.Close()
+
+	remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if err := s.sendSOCKS4Reply(req.Conn, socks4Granted, remote); err != nil {
+		return s.onError(ctx, "reply", req.Conn, fmt.Errorf("failed to send reply: %v", err))
+	}
+
+	sent, received, err := s.tunnel(ctx, conn, req.Conn, buf1, buf2)
+	s.tunnelClosed(req, sent, received, err)
+	if err != nil {
+		return s.onError(ctx, "tunnel", req.Conn, err)
+	}
+	return nil
+}
+
+// readSOCKS4Request reads a SOCKS4 request, with the SOCKS4a
+// hostname extension, from conn.
+func readSOCKS4Request(conn net.Conn) (*Request, error) {
+	var header [8]byte
+	_, err := io.ReadFull(conn, header[:])
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != socks4Version {
+		return nil, fmt.Errorf("%w: SOCKS version %d", ErrUnsupportedVersion, header[0])
+	}
+
+	_, err = readSOCKS4String(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	dest := &Address{Port: int(binary.BigEndian.Uint16(header[2:4]))}
+	ip := net.IP(header[4:8])
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		dest.Name, err = readSOCKS4String(conn)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		dest.IP = net.IPv4(ip[0], ip[1], ip[2], ip[3]).To4()
+	}
+
+	return &Request{
+		Version:         socks4Version,
+		Command:         Command(header[1]),
+		DestinationAddr: dest,
+		Conn:            conn,
+		RemoteAddr:      conn.RemoteAddr(),
+	}, nil
+}
+
+// readSOCKS4String reads a null-terminated string byte by byte,
+// so that nothing sent by the client after it is consumed.
+func readSOCKS4String(r io.Reader) (string, error) {
+	var buf []byte
+	for {
+		b, err := readByte(r)
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(buf), nil
+		}
+		if len(buf) == socks4MaxString {
+			return "", errStringTooLong
+		}
+		buf = append(buf, b)
+	}
+}
+
+// sendSOCKS4Reply sends a SOCKS4 reply to conn, within the HandshakeTimeout if set.
+func (s *Server) sendSOCKS4Reply(conn net.Conn, code byte, addr *net.TCPAddr) error {
+	return s.withWriteDeadline(conn, func() error {
+		return sendSOCKS4Reply(conn, code, addr)
+	})
+}
+
+// socks4ReplyAddr returns the address of a SOCKS4 reply for addr, which
+// is a *net.TCPAddr or an *Address with an IP, as SOCKS4 replies
+// cannot carry a domain name.
+func socks4ReplyAddr(addr net.Addr) (*net.TCPAddr, bool) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr, true
+	case *Address:
+		if addr.IP == nil {
+			return nil, false
+		}
+		return &net.TCPAddr{IP: addr.IP, Port: addr.Port}, true
+	default:
+		return nil, false
+	}
+}
+
+// sendSOCKS4Reply writes a SOCKS4 reply with code and the IPv4
+// address of addr if any.
+func sendSOCKS4Reply(w io.Writer, code byte, addr *net.TCPAddr) error {
+	reply := [8]byte{socks4ReplyVersion, code}
+	if addr != nil {
+		binary.BigEndian.PutUint16(reply[2:4], uint16(addr.Port))
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(reply[4:], ip4)
+		}
+	}
+	_, err := w.Write(reply[:])
+	return err
+}
@@ -0,0 +1,100 @@
+// Package socks5test provides a SOCKS5 server for testing SOCKS5 clients,
+// in the style of net/http/httptest.
+package socks5test
+
+import (
+	"context"
+	"net"
+	"net/url"
+
+	"github.com/wzshiming/socks5"
+)
+
+// TestServer is a SOCKS5 server listening on a random local port
+type TestServer struct {
+	// Server is the served SOCKS5 server, configured by the Options
+	Server *socks5.Server
+	// Listener is the listener of the server
+	Listener net.Listener
+	// Addr is the address the server listens on
+	Addr net.Addr
+	// Username is the username required by WithAuth, if any
+	Username string
+	// Password is the password required by WithAuth, if any
+	Password string
+}
+
+// Option configures a TestServer
+type Option func(s *TestServer)
+
+// WithAuth requires clients to authenticate with username and password
+func WithAuth(username, password string) Option {
+	return func(s *TestServer) {
+		s.Username = username
+		s.Password = password
+		s.Server.Authentication = socks5.UserAuth(username, password)
+	}
+}
+
+// WithDial dials the destinations of CONNECT requests with dial,
+// such as to stub them with in-memory connections, whose replies
+// then carry the address 0.0.0.0:0
+func WithDial(dial socks5.ProxyDialFunc) Option {
+	return func(s *TestServer) {
+		s.Server.ProxyDial = dial
+		s.Server.AdvertisedAddr = func(local net.Addr) net.Addr {
+			switch local.(type) {
+			case *net.TCPAddr, *net.UDPAddr:
+				return local
+			default:
+				return &net.TCPAddr{IP: net.IPv4zero}
+			}
+		}
+	}
+}
+
+// WithTarget connects all CONNECT requests to address,
+// whatever their destination
+func WithTarget(address string) Option {
+	return WithDial(func(ctx context.Context, network string, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	})
+}
+
+// NewTestServer starts a SOCKS5 server on a random port of the
+// loopback interface, which is to be closed with Close
+func NewTestServer(opts ...Option) (*TestServer, error) {
+	s := &TestServer{
+		Server: socks5.NewServer(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	listener, err := s.Server.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s.Listener = listener
+	s.Addr = listener.Addr()
+	go s.Server.Serve(listener)
+	return s, nil
+}
+
+// URL returns the URL of the server, with the credentials of WithAuth,
+// as accepted by socks5.NewDialer
+func (s *TestServer) URL() string {
+	u := url.URL{
+		Scheme: "socks5",
+		Host:   s.Addr.String(),
+	}
+	if s.Username != "" {
+		u.User = url.UserPassword(s.Username, s.Password)
+	}
+	return u.String()
+}
+
+// Close closes the server and its connections
+func (s *TestServer) Close() error {
+	return s.Server.Close()
+}
@@ -0,0 +1,47 @@
+package socks5test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/wzshiming/socks5"
+)
+
+func TestNewTestServer(t *testing.T) {
+	client, target := net.Pipe()
+	go func() {
+		io.WriteString(target, "hello")
+		target.Close()
+	}()
+
+	s, err := NewTestServer(
+		WithAuth("u", "p"),
+		WithDial(func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return client, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	dial, err := socks5.NewDialer(s.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("want hello, got %q", got)
+	}
+}
@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"sync"
+)
+
+// Stats is a snapshot of the Server's counters
+type Stats struct {
+	// ActiveConnections is the number of connections being served
+	ActiveConnections int64
+	// TotalConnections is the number of connections served so far
+	TotalConnections int64
+	// BytesSent is the number of bytes sent from clients through
+	// closed tunnels and UDP associations
+	BytesSent int64
+	// BytesReceived is the number of bytes received by clients through
+	// closed tunnels and UDP associations
+	BytesReceived int64
+	// NoAcceptableMethods is the number of clients that offered
+	// no acceptable authentication method, such as scanners
+	NoAcceptableMethods int64
+	// UDPPacketsTooLarge is the number of datagrams dropped
+	// for being larger than MaxUDPPacketSize
+	UDPPacketsTooLarge int64
+}
+
+// AssociateCounts are the datagrams and payload bytes relayed
+// by a UDP association
+type AssociateCounts struct {
+	// PacketsSent is the number of datagrams sent from the client
+	PacketsSent int64
+	// PacketsReceived is the number of datagrams received by the client
+	PacketsReceived int64
+	// BytesSent is the number of bytes sent from the client
+	BytesSent int64
+	// BytesReceived is the number of bytes received by the client
+	BytesReceived int64
+}
+
+// Stats returns a consistent snapshot of the Server's counters,
+// it is safe to call concurrently with serving connections
+func (s *Server) Stats() Stats {
+	return s.stats.snapshot()
+}
+
+// serverStats are the counters behind Server.Stats,
+// guarded by a mutex so that a snapshot never tears.
+type serverStats struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+func (s *serverStats) connOpened() {
+	s.mu.Lock()
+	s.stats.ActiveConnections++
+	s.stats.TotalConnections++
+	s.mu.Unlock()
+}
+
+func (s *serverStats) connClosed() {
+	s.mu.Lock()
+	s.stats.ActiveConnections--
+	s.mu.Unlock()
+}
+
+func (s *serverStats) addBytes(sent, received int64) {
+	s.mu.Lock()
+	s.stats.BytesSent += sent
+	s.stats.BytesReceived += received
+	s.mu.Unlock()
+}
+
+func (s *serverStats) noAcceptableMethods() {
+	s.mu.Lock()
+	s.stats.NoAcceptableMethods++
+	s.mu.Unlock()
+}
+
+func (s *serverStats) udpPacketTooLarge() {
+	s.mu.Lock()
+	s.stats.UDPPacketsTooLarge++
+	s.mu.Unlock()
+}
+
+func (s *serverStats) snapshot() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"net"
+	"time"
 )
 
 var (
@@ -38,8 +39,8 @@ func (c *UDPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	if n < len(c.prefix) || addr.String() != c.proxyAddress.String() {
 		return 0, nil, errBadHeader
 	}
-	buf := bytes.NewBuffer(c.bufRead[len(c.prefix):])
-	a, err := readAddr(buf)
+	buf := bytes.NewBuffer(c.bufRead[len(c.prefix):n])
+	a, err := ReadAddr(buf)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -89,3 +90,187 @@ func (c *UDPConn) Write(b []byte) (int, error) {
 func (c *UDPConn) RemoteAddr() net.Addr {
 	return c.defaultTarget
 }
+
+// udpAddrEqual reports whether a and b are the same address,
+// comparing *net.UDPAddr field by field to avoid allocating.
+func udpAddrEqual(a, b net.Addr) bool {
+	ua, ok := a.(*net.UDPAddr)
+	if !ok {
+		return a.String() == b.String()
+	}
+	ub, ok := b.(*net.UDPAddr)
+	if !ok {
+		return a.String() == b.String()
+	}
+	return ua.Port == ub.Port && ua.Zone == ub.Zone && ua.IP.Equal(ub.IP)
+}
+
+// udpReassembler reassembles fragmented datagrams as described in
+// RFC 1928 section 7.
+type udpReassembler struct {
+	maxAge time.Duration
+	start  time.Time
+	last   byte
+	active bool
+	buf    []byte
+}
+
+// add queues the fragment data at position frag, and returns the
+// reassembled datagram once the end-of-sequence fragment arrives.
+// Fragments must arrive in order from position 1, otherwise the
+// queue is discarded so that a lost fragment is not skipped.
+func (r *udpReassembler) add(frag byte, data []byte) []byte {
+	pos := frag &^ 0x80
+	now := time.Now()
+	if r.active && now.Sub(r.start) > r.maxAge {
+		r.active = false
+	}
+	switch {
+	case r.active && pos == r.last+1:
+	case pos == 1:
+		r.active = true
+		r.start = now
+		r.buf = r.buf[:0]
+	default:
+		r.active = false
+		return nil
+	}
+	r.last = pos
+	if len(r.buf)+len(data) > maxUdpPacket {
+		r.active = false
+		return nil
+	}
+	r.buf = append(r.buf, data...)
+	if frag&0x80 == 0 {
+		return nil
+	}
+	r.active = false
+	return r.buf
+}
+
+// udpAddrKey is a comparable form of a UDP address,
+// used to look up destinations of an association without allocating.
+type udpAddrKey struct {
+	ip    [net.IPv6len]byte
+	port  int
+	zone  string
+	other string // String of addresses that are not *net.UDPAddr
+}
+
+func newUDPAddrKey(ip net.IP, port int, zone string) udpAddrKey {
+	key := udpAddrKey{port: port, zone: zone}
+	copy(key.ip[:], ip.To16())
+	return key
+}
+
+func udpAddrKeyOf(addr net.Addr) udpAddrKey {
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return newUDPAddrKey(u.IP, u.Port, u.Zone)
+	}
+	return udpAddrKey{other: addr.String()}
+}
+
+const (
+	// maxUDPTargets is the number of destinations an association
+	// keeps, the least recently used one is forgotten beyond it.
+	maxUDPTargets = 1024
+	// maxUDPNames is the number of resolved names an association caches.
+	maxUDPNames = 1024
+	// udpNameTTL is how long an association caches a resolved name.
+	udpNameTTL = time.Minute
+)
+
+// udpTarget is a destination of an association.
+type udpTarget struct {
+	addr *net.UDPAddr
+	// prefix is the header of datagrams relayed from addr to the client
+	prefix []byte
+	used   time.Time
+}
+
+// udpTargets is a bounded set of the destinations of an association,
+// whose replies are relayed to the client.
+type udpTargets struct {
+	max     int
+	targets map[udpAddrKey]*udpTarget
+}
+
+func newUDPTargets(max int) *udpTargets {
+	return &udpTargets{max: max, targets: map[udpAddrKey]*udpTarget{}}
+}
+
+func (t *udpTargets) get(key udpAddrKey, now time.Time) (*udpTarget, bool) {
+	target, ok := t.targets[key]
+	if ok {
+		target.used = now
+	}
+	return target, ok
+}
+
+// add adds target, forgetting the least recently used one if full.
+func (t *udpTargets) add(key udpAddrKey, target *udpTarget, now time.Time) {
+	if len(t.targets) >= t.max {
+		var oldest udpAddrKey
+		var oldestUsed time.Time
+		for k, v := range t.targets {
+			if oldestUsed.IsZero() || v.used.Before(oldestUsed) {
+				oldest, oldestUsed = k, v.used
+			}
+		}
+		delete(t.targets, oldest)
+	}
+	target.used = now
+	t.targets[key] = target
+}
+
+// udpNames is a bounded cache of the names resolved by an association.
+type udpNames struct {
+	max   int
+	ttl   time.Duration
+	names map[string]udpName
+}
+
+type udpName struct {
+	ip      net.IP
+	expires time.Time
+}
+
+func newUDPNames(max int, ttl time.Duration) *udpNames {
+	return &udpNames{max: max, ttl: ttl, names: map[string]udpName{}}
+}
+
+func (c *udpNames) get(name string, now time.Time) net.IP {
+	n, ok := c.names[name]
+	if !ok || now.After(n.expires) {
+		return nil
+	}
+	return n.ip
+}
+
+// add caches ip for name, dropping expired names, or any one, if full.
+func (c *udpNames) add(name string, ip net.IP, now time.Time) {
+	if len(c.names) >= c.max {
+		for k, v := range c.names {
+			if now.After(v.expires) {
+				delete(c.names, k)
+			}
+		}
+		for k := range c.names {
+			if len(c.names) < c.max {
+				break
+			}
+			delete(c.names, k)
+		}
+	}
+	c.names[name] = udpName{ip: ip, expires: now.Add(c.ttl)}
+}
+
+func newUDPTarget(ip net.IP, port int) (*udpTarget, error) {
+	addr := &net.UDPAddr{IP: ip, Port: port}
+	b := bytes.NewBuffer(make([]byte, 3, 22))
+	err := WriteAddr(b, &Address{IP: ip, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	return &udpTarget{addr: addr, prefix: b.Bytes()}, nil
+}